@@ -27,11 +27,42 @@
 // in the tree without knowing its key or position in the tree that work in O(1) for every leaf!
 // The last element links to the first and the first back to the last element.
 // The tree has its own memory manager to avoid frequent allocations for single nodes that are created or removed.
+//
+// There are four boundary queries to find the leaf closest to a value v that is not necessarily in the tree.
+// For a tree with the values 1, 2, 2, 3:
+//
+//	FindFirstLargerLeaf(2)         // >= 2: the first leaf with value 2
+//	FindFirstStrictlyLargerLeaf(2) // >  2: the leaf with value 3
+//	FindLastSmallerOrEqualLeaf(2)  // <= 2: the last leaf with value 2
+//	FindLastSmallerLeaf(2)         // <  2: the leaf with value 1
+//
+// All of them return an error, if there is no such leaf. They never wrap around the circular leaf list.
+//
+// Values of +Inf and -Inf are allowed. -Inf sorts before all finite values and +Inf after them.
+// Queries with infinite bounds include everything up to that side, so
+// AppendValuesInRange(nil, math.Inf(-1), math.Inf(1)) returns all elements.
+// NaN values are not supported.
 package tree23
 
 import (
+	"bufio"
+	"context"
+	"encoding"
+	"encoding/binary"
+	"encoding/csv"
 	"errors"
 	"fmt"
+	"io"
+	"math"
+	"math/bits"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"unsafe"
 )
 
 // TreeElement is the interface that needs to be implemented in order insert an element into
@@ -60,6 +91,8 @@ type treeNode struct {
 	cCount   int
 	// For all inner nodes, elem will be nil. Only leaf nodes contain a valid value!
 	elem TreeElement
+	// The key of elem used for ordering, so ExtractValue is only called once per leaf.
+	key float64
 	// Links to the next or previous leaf node. This should build a continuous linked list
 	// at the leaf level! Making range queries or iterations O(1).
 	// Can only be expected to be valid for leaf nodes!
@@ -74,6 +107,42 @@ type Tree23 struct {
 	// Root node access to the tree.
 	root TreeNodeIndex
 
+	// The tree is sorted in descending order. All keys are negated internally.
+	descending bool
+
+	// The tree is a set and never stores two equal elements.
+	unique bool
+
+	// Number of elements (leaf nodes) in the tree.
+	length int
+
+	// The leaf with the smallest element or -1 for an empty tree.
+	// The largest leaf is always its predecessor in the circular leaf list.
+	minLeaf TreeNodeIndex
+
+	// Optional order of elements with the same value.
+	tieBreaker func(a, b TreeElement) bool
+
+	// Optional journal that records every insert and delete before it is applied.
+	journal    io.Writer
+	journalErr error
+	journalBuf []byte
+
+	// Optional callbacks for every element that is added to or removed from the tree.
+	onInsert func(TreeElement)
+	onDelete func(TreeElement)
+
+	// Optional sink for per-operation metrics.
+	metrics Metrics
+
+	// Conversion of elements from and to text for MarshalText and UnmarshalText.
+	textFormat  func(TreeElement) string
+	textFactory func(float64) TreeElement
+	textParse   func(string) (TreeElement, error)
+
+	// Factories for MarshalBinary and UnmarshalBinary by the name of the element type.
+	elementTypes map[string]func([]byte) (TreeElement, error)
+
 	// Caching of often used arrays/slices.
 	oneElemTreeList   []TreeNodeIndex
 	twoElemTreeList   []TreeNodeIndex
@@ -84,6 +153,45 @@ type Tree23 struct {
 	treeNodes              []treeNode
 	treeNodesFirstFreePos  int
 	treeNodesFreePositions stack
+
+	// A frozen tree panics on every modification.
+	frozen bool
+
+	// The memory of the nodes is shared with a snapshot and has to be copied before the next modification.
+	shared bool
+
+	// All leaves in sorted order for FindInterpolated or nil. It is built once enough lookups since the last
+	// modification paid for it and dropped by every modification.
+	leafOrder       []TreeNodeIndex
+	leafOrderMisses int
+
+	// The last Insert (journalInsert), Delete (journalDelete) or UpdateKey/InsertBounded (undoUpdate) that can be reversed with Undo.
+	// undoOp is 0, if there is nothing to undo. undoLeaf is the inserted leaf, undoElem and undoKey
+	// the deleted element and its key.
+	undoOp   byte
+	undoElem TreeElement
+	undoKey  float64
+	undoLeaf TreeNodeIndex
+
+	// Maximum number of elements for InsertBounded or 0 for no limit, and what happens when it is reached.
+	maxLen      int
+	evictPolicy EvictPolicy
+
+	// Run the invariant checks after every Insert and Delete. Only meant for debugging.
+	invariantChecks bool
+
+	// Check and repair the leaf list after every Delete and report repairs to repairLogger.
+	autoRepair   bool
+	repairLogger func(string)
+
+	// Statistics of the memory management.
+	allocFromCache int64
+	allocFresh     int64
+	allocRecycled  int64
+
+	// Number of nodes, that were split by inserts or merged by deletes.
+	splits int64
+	merges int64
 }
 
 // Internal stack implementation for reusing memory of recycled nodes.
@@ -105,6 +213,8 @@ func (s *stack) pop() TreeNodeIndex {
 func (tree *Tree23) initializeTree(capacity int) {
 
 	tree.root = 0
+	tree.length = 0
+	tree.minLeaf = -1
 
 	tree.oneElemTreeList = []TreeNodeIndex{-1}
 	tree.twoElemTreeList = []TreeNodeIndex{-1, -1}
@@ -114,22 +224,34 @@ func (tree *Tree23) initializeTree(capacity int) {
 	tree.treeNodes = make([]treeNode, capacity, capacity)
 	for i := 0; i < len(tree.treeNodes); i++ {
 		var a [3]treeLink
-		tree.treeNodes[i] = treeNode{a, 0, nil, -1, -1}
+		tree.treeNodes[i] = treeNode{a, 0, nil, 0, -1, -1}
 	}
 	tree.treeNodesFirstFreePos = 1
-	tree.treeNodesFreePositions = make(stack, 0, 0)
+	// Deleting all elements frees about every node. Half of that avoids most re-allocations of the
+	// stack for delete-heavy use without reserving too much memory upfront.
+	tree.treeNodesFreePositions = make(stack, 0, capacity/2)
 }
 
 // NewCapacity Works exactly like New without parameters, but pre-allocated memory for the
 // specified amount of maximum nodes beforehand. This may save some time for tree memory growing.
+// The stack of recycled nodes is pre-allocated proportionally as well, which helps delete-heavy use.
 // If in doubt, use the normal New or provide a smaller number. The tree will not run out of memory!
+// A capacity smaller than 1 is treated as 1, as the tree always needs memory for the root.
 func NewCapacity(expectedCapacity int) *Tree23 {
 
 	var t Tree23
-	t.initializeTree(expectedCapacity)
+	t.initializeTree(max(expectedCapacity, 1))
 	return &t
 }
 
+// NewCapacityChecked works like NewCapacity, but returns an error for a capacity smaller than 1.
+func NewCapacityChecked(expectedCapacity int) (*Tree23, error) {
+	if expectedCapacity < 1 {
+		return nil, errors.New("NewCapacityChecked() needs a capacity of at least 1")
+	}
+	return NewCapacity(expectedCapacity), nil
+}
+
 // New creates a new tree that has no children and is not a leaf node!
 // An empty tree from New can be used as base for inserting/deleting/searching.
 // Runs in O(1)
@@ -137,6 +259,217 @@ func New() *Tree23 {
 	return NewCapacity(1)
 }
 
+// Clone returns a deep copy of the tree that shares no memory with the original.
+// Node indices of the original tree stay valid for the clone.
+// Runs in O(n)
+func (tree *Tree23) Clone() *Tree23 {
+	t := tree.shallowCopy()
+	t.copyMemory()
+	return t
+}
+
+// CopyFrom replaces all elements of the tree with the elements of src, reusing the memory of the tree where possible.
+// Other than Clone, no new tree has to be allocated, which helps when copying repeatedly.
+// The tree also takes over the order of src (NewDescending, NewSet and the tie breaker) and node indices of src
+// stay valid for the tree. So a tree from NewSet only stays a set, if src is one as well, and never holds equal elements.
+// Journal and hooks of the tree are kept and get all removed and inserted elements, like with Replace.
+// Runs in O(n)
+func (tree *Tree23) CopyFrom(src *Tree23) {
+
+	tree.beginMutation()
+	if tree == src {
+		return
+	}
+	tree.clear()
+
+	tree.treeNodes = append(tree.treeNodes[:0], src.treeNodes...)
+	tree.treeNodesFreePositions = append(tree.treeNodesFreePositions[:0], src.treeNodesFreePositions...)
+	tree.treeNodesFirstFreePos = src.treeNodesFirstFreePos
+	tree.root = src.root
+	tree.length = src.length
+	tree.minLeaf = src.minLeaf
+	tree.descending = src.descending
+	tree.unique = src.unique
+	tree.tieBreaker = src.tieBreaker
+	tree.writeJournalMode()
+
+	if tree.journal != nil || tree.onInsert != nil {
+		for _, l := range tree.LeafIndices() {
+			tree.writeJournal(journalInsert, tree.treeNodes[l].elem)
+			if tree.onInsert != nil {
+				tree.onInsert(tree.treeNodes[l].elem)
+			}
+		}
+	}
+}
+
+// Snapshot returns an independent copy of the tree for concurrent readers.
+// The tree itself is not safe for concurrent use. The intended pattern with one writer and many readers is:
+// Take the write lock, call Snapshot, release the lock and hand the snapshot to the readers.
+// The readers can then traverse the snapshot without any locking, while the writer keeps mutating the tree.
+//
+// The snapshot shares the memory with the tree (copy-on-write). Taking a snapshot is cheap, but the next
+// modification of the tree (or of the snapshot) copies the whole memory once before changing anything.
+// Node indices of the tree stay valid for the snapshot.
+// Runs in O(1)
+func (tree *Tree23) Snapshot() *Tree23 {
+	t := tree.shallowCopy()
+	t.shared = true
+	// A frozen tree can not be modified and might be read by other goroutines at the same time.
+	if !tree.frozen {
+		tree.shared = true
+	}
+	return t
+}
+
+// shallowCopy returns a copy of the tree, that still shares the memory for all nodes with the original.
+// The new tree has its own helper lists and no journal, hooks, metrics or freeze.
+func (tree *Tree23) shallowCopy() *Tree23 {
+
+	t := *tree
+
+	t.oneElemTreeList = []TreeNodeIndex{-1}
+	t.twoElemTreeList = []TreeNodeIndex{-1, -1}
+	t.threeElemTreeList = []TreeNodeIndex{-1, -1, -1}
+	t.nineElemTreeList = []TreeNodeIndex{-1, -1, -1, -1, -1, -1, -1, -1, -1}
+
+	// A copy must never write into the journal of the original tree.
+	t.journal = nil
+	t.journalErr = nil
+	t.journalBuf = nil
+	t.onInsert = nil
+	t.onDelete = nil
+	t.metrics = nil
+	t.frozen = false
+
+	return &t
+}
+
+// copyMemory copies all nodes and the stack of recycled nodes, so no memory is shared with other trees.
+// Runs in O(n)
+func (tree *Tree23) copyMemory() {
+	nodes := make([]treeNode, len(tree.treeNodes))
+	copy(nodes, tree.treeNodes)
+	tree.treeNodes = nodes
+
+	free := make(stack, len(tree.treeNodesFreePositions))
+	copy(free, tree.treeNodesFreePositions)
+	tree.treeNodesFreePositions = free
+
+	tree.shared = false
+}
+
+// NewDescending creates a new empty tree, that is sorted in descending instead of increasing order.
+// All functions that refer to the order of the tree follow the descending order. So GetSmallestLeaf
+// returns the leaf with the largest value, Next moves to a smaller value and FindFirstLargerLeaf(v) returns
+// the first leaf with a value smaller or equal than v.
+// Runs in O(1)
+func NewDescending() *Tree23 {
+	t := New()
+	t.descending = true
+	return t
+}
+
+// NewSet creates a new empty tree, that never stores two equal elements.
+// Insert of an element equal to one already in the tree is a no-op. Use InsertUnique to find out,
+// if the element was inserted.
+// Runs in O(1)
+func NewSet() *Tree23 {
+	t := New()
+	t.unique = true
+	return t
+}
+
+// key returns the value of elem, that is used for ordering the tree.
+func (tree *Tree23) key(elem TreeElement) float64 {
+	if tree.descending {
+		return -elem.ExtractValue()
+	}
+	return elem.ExtractValue()
+}
+
+// keyOf converts the value v to a key used for ordering the tree and a key back to its value.
+func (tree *Tree23) keyOf(v float64) float64 {
+	if tree.descending {
+		return -v
+	}
+	return v
+}
+
+// leafKey returns the cached key of the leaf t.
+func (tree *Tree23) leafKey(t TreeNodeIndex) float64 {
+	return tree.treeNodes[t].key
+}
+
+// Freeze makes the tree read-only. Every function that modifies the tree panics afterwards,
+// all queries work as usual. A frozen tree can be shared between goroutines without locking.
+// Runs in O(1)
+func (tree *Tree23) Freeze() {
+	tree.frozen = true
+}
+
+// Thaw makes a frozen tree modifiable again.
+// Snapshots of a frozen tree don't mark the tree as shared, so the next modification copies the memory once.
+// Runs in O(1)
+func (tree *Tree23) Thaw() {
+	if tree.frozen {
+		tree.shared = true
+	}
+	tree.frozen = false
+}
+
+// AtomicTree holds a tree, that is read by many goroutines without locking and replaced as a whole by a writer.
+// Readers call Load and query the returned tree. A writer builds a new tree and publishes it with AtomicSwap.
+// Readers that still use the old tree keep working on it until they call Load again.
+// The zero value holds no tree.
+type AtomicTree struct {
+	current atomic.Pointer[Tree23]
+}
+
+// NewAtomicTree returns an AtomicTree holding tree. See AtomicSwap.
+func NewAtomicTree(tree *Tree23) *AtomicTree {
+	a := &AtomicTree{}
+	a.AtomicSwap(tree)
+	return a
+}
+
+// Load returns the current tree or nil, if no tree was set. The tree is frozen and must not be modified.
+// Runs in O(1)
+func (a *AtomicTree) Load() *Tree23 {
+	return a.current.Load()
+}
+
+// AtomicSwap freezes newTree and makes it the current tree for all following calls to Load.
+// The previous tree is returned. It stays frozen, as readers might still use it.
+// newTree must not be modified after the swap.
+// Runs in O(1)
+func (a *AtomicTree) AtomicSwap(newTree *Tree23) *Tree23 {
+	if newTree != nil {
+		newTree.Freeze()
+	}
+	return a.current.Swap(newTree)
+}
+
+// IsFrozen returns true, if the tree was frozen with Freeze.
+// Runs in O(1)
+func (tree *Tree23) IsFrozen() bool {
+	return tree.frozen
+}
+
+// beginMutation has to be called by all exported functions that modify the tree before changing anything.
+func (tree *Tree23) beginMutation() {
+	if tree.frozen {
+		panic("tree23: modification of a frozen tree")
+	}
+	if tree.shared {
+		tree.copyMemory()
+	}
+	tree.undoOp = 0
+	tree.undoElem = nil
+	tree.leafOrder = nil
+	tree.leafOrderMisses = 0
+}
+
 // IsLeaf returns true, if the given tree is a leaf node.
 // Runs in O(1)
 func (tree *Tree23) IsLeaf(t TreeNodeIndex) bool {
@@ -149,6 +482,18 @@ func (tree *Tree23) IsEmpty(t TreeNodeIndex) bool {
 	return tree.IsLeaf(t) && tree.treeNodes[t].elem == nil
 }
 
+// IsEmptyTree returns true, if the tree has no elements. This is the same as Len() == 0.
+// Runs in O(1)
+func (tree *Tree23) IsEmptyTree() bool {
+	return tree.length == 0
+}
+
+// Len returns the number of elements in the tree.
+// Runs in O(1)
+func (tree *Tree23) Len() int {
+	return tree.length
+}
+
 // GetValue returns the value from a tree node.
 // GetValue only works for leafs, as there is no data stored in other tree nodes!
 // Please take care to only call GetValue on leaf nodes.
@@ -157,12 +502,24 @@ func (tree *Tree23) GetValue(t TreeNodeIndex) TreeElement {
 	return tree.treeNodes[t].elem
 }
 
+// Value works like GetValue, but checks t first. If t is out of range or not a leaf with an element
+// (an internal node or a deleted leaf), nil and false are returned instead of panicking.
+// A deleted leaf can be reused by later inserts, so Value can not detect every stale index.
+// Runs in O(1)
+func (tree *Tree23) Value(t TreeNodeIndex) (TreeElement, bool) {
+	if !tree.isLeafNode(t) {
+		return nil, false
+	}
+	return tree.treeNodes[t].elem, true
+}
+
 // ChangeValue edits the value of a leaf node on the fly.
 // ChangeValue only works for leafs, as there is no data stored in other tree nodes!
 // Be very careful, to never edit properties, that may change the position in the tree!
 // If the outcome of .ExtractValue() changes, the whole tree may become invalid beyond repair!
 // Runs in O(1)
 func (tree *Tree23) ChangeValue(t TreeNodeIndex, e TreeElement) {
+	tree.beginMutation()
 	if tree.IsLeaf(t) && tree.treeNodes[t].elem.Equal(e) {
 		tree.treeNodes[t].elem = e
 	}
@@ -172,18 +529,87 @@ func (tree *Tree23) ChangeValue(t TreeNodeIndex, e TreeElement) {
 // on equality. This allows the user to edit elements that might make the new version
 // unequal to the current one.
 // The user needs to take care, that the key is NEVER changed during this operation!!!
+// CheckOrdering can be used to find leaves with a changed key afterwards.
 func (tree *Tree23) ChangeValueUnsafe(t TreeNodeIndex, e TreeElement) {
+	tree.beginMutation()
 	if tree.IsLeaf(t) {
 		tree.treeNodes[t].elem = e
 	}
 }
 
+// UpdateKey replaces the element of the leaf t with newElem, which may have a different value than the old element.
+// Other than ChangeValueUnsafe, the leaf is deleted and newElem is inserted again, so the tree stays valid.
+// Returns the new leaf of newElem. The leaf t must not be used afterwards.
+// An error is returned and nothing changes, if t is not a leaf in the tree or if the tree is from NewSet
+// and another leaf with an element equal to newElem exists already.
+// Runs in O(log(n))
+func (tree *Tree23) UpdateKey(t TreeNodeIndex, newElem TreeElement) (TreeNodeIndex, error) {
+
+	if !tree.isLeafNode(t) {
+		return -1, errors.New("UpdateKey() only works for leaf nodes in the tree")
+	}
+	if tree.unique {
+		if l := tree.findEqual(newElem); l != -1 && l != t {
+			return -1, errors.New("An equal element exists already in the tree.")
+		}
+	}
+
+	oldElem, oldKey := tree.treeNodes[t].elem, tree.leafKey(t)
+	if err := tree.DeleteNode(t); err != nil {
+		return -1, err
+	}
+	tree.insertChecked(newElem, tree.key(newElem), false, false)
+
+	// Undo has to reverse both the delete and the insert.
+	tree.undoOp = undoUpdate
+	tree.undoElem = oldElem
+	tree.undoKey = oldKey
+	return tree.undoLeaf, nil
+}
+
+// MapMonotonic replaces every element with the result of transform, which may change the values of the elements.
+// transform must preserve the order of all elements: For elements a and b with a before b in the tree,
+// transform(a) must not be sorted after transform(b). Otherwise the tree is broken afterwards.
+// Other than deleting and inserting all elements again, the structure of the tree is not changed.
+// Only the cached values are updated. Like ChangeValue, this is not journaled and does not call the hooks.
+// Runs in O(n)
+func (tree *Tree23) MapMonotonic(transform func(TreeElement) TreeElement) {
+
+	tree.beginMutation()
+	if tree.IsEmpty(tree.root) {
+		return
+	}
+
+	for l := tree.minLeaf; ; {
+		e := transform(tree.treeNodes[l].elem)
+		tree.treeNodes[l].elem = e
+		tree.treeNodes[l].key = tree.key(e)
+		l = tree.treeNodes[l].next
+		if l == tree.minLeaf {
+			break
+		}
+	}
+	tree.updateMaxChildrenRec(tree.root)
+}
+
+// updateMaxChildrenRec recomputes the cached maximum of all children in t from the leaves and returns the maximum of t.
+func (tree *Tree23) updateMaxChildrenRec(t TreeNodeIndex) float64 {
+	if tree.IsLeaf(t) {
+		return tree.leafKey(t)
+	}
+	for i := 0; i < tree.treeNodes[t].cCount; i++ {
+		tree.treeNodes[t].children[i].maxChild = tree.updateMaxChildrenRec(tree.treeNodes[t].children[i].child)
+	}
+	return tree.max(t)
+}
+
 // newNode returns a new node from cache or triggers a re-allocation for more memory!
 func (tree *Tree23) newNode() TreeNodeIndex {
 
 	// Recycle a deleted node.
 	if tree.treeNodesFreePositions.len() > 0 {
 		node := TreeNodeIndex(tree.treeNodesFreePositions.pop())
+		tree.allocFromCache++
 		return node
 	}
 
@@ -199,6 +625,7 @@ func (tree *Tree23) newNode() TreeNodeIndex {
 	}
 
 	// Get node from cached memory.
+	tree.allocFresh++
 	tree.treeNodesFirstFreePos++
 	return TreeNodeIndex(tree.treeNodesFirstFreePos - 1)
 }
@@ -212,15 +639,57 @@ func (tree *Tree23) recycleNode(n TreeNodeIndex) {
 	tree.treeNodes[n].prev = -1
 
 	tree.treeNodesFreePositions.push(n)
+	tree.allocRecycled++
+}
+
+// AllocStats returns how many nodes were taken from the stack of recycled nodes (fromCache),
+// how many were newly taken from the pre-allocated memory (fresh) and how many nodes were recycled
+// over the lifetime of the tree.
+// Runs in O(1)
+func (tree *Tree23) AllocStats() (fromCache, fresh, recycled int64) {
+	return tree.allocFromCache, tree.allocFresh, tree.allocRecycled
+}
+
+// StructuralOps returns how many nodes were split by inserts and how many were merged into other nodes
+// by deletes over the lifetime of the tree. This shows the cost of rebalancing for a workload.
+// Functions that build the tree in bulk, like BuildFromSorted or Replace, don't split any nodes.
+// Runs in O(1)
+func (tree *Tree23) StructuralOps() (splits, merges int64) {
+	return tree.splits, tree.merges
+}
+
+// MemoryBytes returns the approximate number of bytes held by the nodes of the tree and the stack of recycled nodes.
+// The elements themselves are not included, only the interface values referencing them.
+// Runs in O(1)
+func (tree *Tree23) MemoryBytes() int {
+	var n treeNode
+	var i TreeNodeIndex
+	return cap(tree.treeNodes)*int(unsafe.Sizeof(n)) + cap(tree.treeNodesFreePositions)*int(unsafe.Sizeof(i))
 }
 
-// newLeaf creates a new leaf node with an element and correct pointers.
-func (tree *Tree23) newLeaf(elem TreeElement, prev, next TreeNodeIndex) TreeNodeIndex {
+// TrimFreeList releases unused memory of the internal stack of recycled nodes.
+// If the stack has more than twice the capacity it currently needs, it is copied into a stack of fitting size.
+// No node is moved, so all node indices stay valid.
+// Runs in O(k) for k recycled nodes
+func (tree *Tree23) TrimFreeList() {
+	tree.beginMutation()
+	free := tree.treeNodesFreePositions
+	if cap(free) <= 2*len(free) {
+		return
+	}
+	trimmed := make(stack, len(free))
+	copy(trimmed, free)
+	tree.treeNodesFreePositions = trimmed
+}
+
+// newLeaf creates a new leaf node with an element, its key and correct pointers.
+func (tree *Tree23) newLeaf(elem TreeElement, key float64, prev, next TreeNodeIndex) TreeNodeIndex {
 
 	n := tree.newNode()
 
 	tree.treeNodes[n].cCount = 0
 	tree.treeNodes[n].elem = elem
+	tree.treeNodes[n].key = key
 	tree.treeNodes[n].prev = prev
 	tree.treeNodes[n].next = next
 
@@ -230,7 +699,7 @@ func (tree *Tree23) newLeaf(elem TreeElement, prev, next TreeNodeIndex) TreeNode
 // max returns the maximum element of the biggest subtree.
 func (tree *Tree23) max(t TreeNodeIndex) float64 {
 	if tree.IsLeaf(t) {
-		return tree.treeNodes[t].elem.ExtractValue()
+		return tree.leafKey(t)
 	}
 	c := tree.treeNodes[t].cCount - 1
 	return tree.treeNodes[t].children[c].maxChild
@@ -276,10 +745,9 @@ func (tree *Tree23) multipleNodesFromChildrenList(children *[]TreeNodeIndex, cLe
 	return nil
 }
 
-// insertInto returns the first position bigger than the element itself or the last child to insert into!
-func (tree *Tree23) insertInto(t TreeNodeIndex, elem TreeElement) int {
+// insertInto returns the first position bigger than the key v or the last child to insert into!
+func (tree *Tree23) insertInto(t TreeNodeIndex, v float64) int {
 
-	v := elem.ExtractValue()
 	for i := 0; i < tree.treeNodes[t].cCount; i++ {
 		// Find the tree with the smallest maximumChild bigger than elem itself!
 		if v < tree.treeNodes[t].children[i].maxChild {
@@ -310,33 +778,79 @@ func (tree *Tree23) distributeFourChildren(c1, c2, c3, c4 TreeNodeIndex) TreeNod
 	return tree.distributeTwoChildren(child1, child2)
 }
 
-// insertRec handles ecursive insertion. Returns a list of trees that are all on one level.
-func (tree *Tree23) insertRec(t TreeNodeIndex, elem TreeElement) *[]TreeNodeIndex {
+// insertion describes where a new leaf is inserted. It is passed down unchanged by insertRec.
+type insertion struct {
+	// The key of the new element.
+	key float64
+	// Insert after the largest leaf without comparing any values.
+	appendLast bool
+	// The specific leaf to insert directly after or before (or -1) and the way down from the root to it.
+	after, before TreeNodeIndex
+	path          []int
+}
+
+// insertPosition returns the child of t on the given depth to insert into.
+func (tree *Tree23) insertPosition(t TreeNodeIndex, ins *insertion, depth int) int {
+	switch {
+	case ins.appendLast:
+		return tree.treeNodes[t].cCount - 1
+	case ins.after != -1 || ins.before != -1:
+		return ins.path[depth]
+	}
+	return tree.insertInto(t, ins.key)
+}
+
+// insertRec handles ecursive insertion. Returns a list of trees that are all on one level and the new leaf.
+// If ins.appendLast is set, elem is inserted after the last leaf of t without comparing any values.
+// If ins.after is set, elem is inserted directly after this leaf following ins.path from the given depth.
+// ins.before works the same, but inserts elem directly before the leaf.
+// Otherwise elem is inserted after all leaves with the same value.
+// Equal elements are kept next to each other. If there is an equal element further in front of the insert
+// position, nothing is inserted and nil is returned together with that leaf.
+func (tree *Tree23) insertRec(t TreeNodeIndex, elem TreeElement, ins *insertion, depth int) (*[]TreeNodeIndex, TreeNodeIndex) {
 
 	if tree.IsLeaf(t) {
 
-		if tree.treeNodes[t].elem.ExtractValue() < elem.ExtractValue() {
-			leaf := tree.newLeaf(elem, t, tree.treeNodes[t].next)
+		after := ins.before != t && (ins.appendLast || ins.after == t || tree.leafKey(t) <= ins.key)
+		if ins.after == -1 {
+			p := t
+			if !after {
+				p = -1
+				if t != tree.minLeaf {
+					p = tree.treeNodes[t].prev
+				}
+			}
+			if e := tree.equalBefore(p, elem, ins.key); e != -1 {
+				return nil, e
+			}
+		}
+
+		var leaf TreeNodeIndex
+		if after {
+			leaf = tree.newLeaf(elem, ins.key, t, tree.treeNodes[t].next)
 			tree.treeNodes[t].next = leaf
 			tree.treeNodes[tree.treeNodes[leaf].next].prev = leaf
 
 			tree.twoElemTreeList[0] = t
 			tree.twoElemTreeList[1] = leaf
 		} else {
-			leaf := tree.newLeaf(elem, tree.treeNodes[t].prev, t)
+			leaf = tree.newLeaf(elem, ins.key, tree.treeNodes[t].prev, t)
 			tree.treeNodes[t].prev = leaf
 			tree.treeNodes[tree.treeNodes[leaf].prev].next = leaf
 
 			tree.twoElemTreeList[0] = leaf
 			tree.twoElemTreeList[1] = t
 		}
-		return &tree.twoElemTreeList
+		return &tree.twoElemTreeList, leaf
 
 	}
-	subTree := tree.insertInto(t, elem)
+	subTree := tree.insertPosition(t, ins, depth)
 	// Recursive call to get a list of children back for redistribution :)
 	// There can only ever be 1 or 2 children from the recursion!!!
-	newChildren := tree.insertRec(tree.treeNodes[t].children[subTree].child, elem)
+	newChildren, leaf := tree.insertRec(tree.treeNodes[t].children[subTree].child, elem, ins, depth+1)
+	if newChildren == nil {
+		return nil, leaf
+	}
 
 	// If we only get one child back, there is no re-ordering
 	// necessary and the child can just be overwritten with the updated one.
@@ -347,7 +861,7 @@ func (tree *Tree23) insertRec(t TreeNodeIndex, elem TreeElement) *[]TreeNodeInde
 
 		tree.oneElemTreeList[0] = t
 
-		return &tree.oneElemTreeList
+		return &tree.oneElemTreeList, leaf
 	}
 
 	// Two children and two in our current tree. One of which is the updated
@@ -373,9 +887,11 @@ func (tree *Tree23) insertRec(t TreeNodeIndex, elem TreeElement) *[]TreeNodeInde
 
 		tree.oneElemTreeList[0] = t
 
-		return &tree.oneElemTreeList
+		return &tree.oneElemTreeList, leaf
 	}
 
+	// The node already has three children and is split into two nodes.
+	tree.splits++
 	defer tree.recycleNode(t)
 
 	tmpChild0 := (*newChildren)[0]
@@ -396,28 +912,329 @@ func (tree *Tree23) insertRec(t TreeNodeIndex, elem TreeElement) *[]TreeNodeInde
 		tree.twoElemTreeList[1] = tree.distributeTwoChildren(tmpChild0, tmpChild1)
 	}
 
-	return &tree.twoElemTreeList
+	return &tree.twoElemTreeList, leaf
 }
 
 // Insert inserts a given element into the tree.
+// For a tree from NewSet, nothing is inserted if an equal element already exists.
 // Runs in O(log(n))
 func (tree *Tree23) Insert(elem TreeElement) {
+	tree.insertChecked(elem, tree.key(elem), tree.unique, false)
+}
+
+// InsertWithKey works like Insert, but uses value instead of calling elem.ExtractValue() to find the position.
+// The value is stored in the leaf, so later operations on the leaf don't call ExtractValue either.
+// The caller has to make sure, that value is exactly the value of elem.
+// Runs in O(log(n))
+func (tree *Tree23) InsertWithKey(value float64, elem TreeElement) {
+	tree.insertChecked(elem, tree.keyOf(value), tree.unique, false)
+}
+
+// InsertMonotonic works like Insert, but is faster for elements that are inserted in increasing order.
+// If elem is not smaller than the largest element, it is appended along the right border of the tree
+// without comparing any values on the way down. Otherwise it is inserted like with Insert.
+// Other than InsertWithHint, no leaf has to be remembered by the caller.
+// Runs in O(log(n))
+func (tree *Tree23) InsertMonotonic(elem TreeElement) {
+	k := tree.key(elem)
+	appendLast := false
+	if tree.length > 0 {
+		// Elements with the same value might have to be ordered by the tie breaker.
+		v := tree.leafKey(tree.treeNodes[tree.minLeaf].prev)
+		appendLast = v < k || v == k && tree.tieBreaker == nil
+	}
+	tree.insertChecked(elem, k, tree.unique, appendLast)
+}
+
+// InsertUnique inserts a given element into the tree, if no equal element exists already.
+// Returns true, if elem was inserted. This works for every tree, not only for trees from NewSet.
+// Runs in O(log(n))
+func (tree *Tree23) InsertUnique(elem TreeElement) bool {
+	return tree.insertChecked(elem, tree.key(elem), true, false)
+}
+
+// insertChecked inserts elem with the key k and returns true. If unique is set and an equal element
+// exists already, nothing is inserted and false is returned. See insert for appendLast.
+func (tree *Tree23) insertChecked(elem TreeElement, k float64, unique, appendLast bool) bool {
+
+	tree.beginMutation()
+	if unique && tree.findEqualKey(elem, k) != -1 {
+		return false
+	}
+	tree.writeJournal(journalInsert, elem)
+	depth := tree.metricsDepth()
+	tree.undoLeaf = tree.insert(elem, k, appendLast)
+	tree.undoOp = journalInsert
+	tree.checkInvariant("Insert", elem)
+	if tree.metrics != nil {
+		tree.metrics.ObserveInsert(depth)
+	}
+
+	if tree.onInsert != nil {
+		tree.onInsert(elem)
+	}
+	return true
+}
+
+// EvictPolicy defines what InsertBounded does, if the tree already has the maximum number of elements.
+type EvictPolicy int
+
+const (
+	// RejectWhenFull does not insert the new element.
+	RejectWhenFull EvictPolicy = iota
+	// EvictSmallest inserts the new element and removes the smallest element.
+	EvictSmallest
+	// EvictLargest inserts the new element and removes the largest element.
+	EvictLargest
+)
+
+// SetMaxLen sets the maximum number of elements for InsertBounded and what happens, if it is reached.
+// n <= 0 removes the limit. Elements that are already in the tree are not removed.
+// Other functions like Insert ignore the limit.
+func (tree *Tree23) SetMaxLen(n int, policy EvictPolicy) {
+	tree.maxLen = n
+	tree.evictPolicy = policy
+}
+
+// InsertBounded works like Insert, but keeps the number of elements within the limit set with SetMaxLen.
+// If the tree is full, the new element is either rejected or the smallest or largest element is removed after
+// inserting it. Removed elements are journaled and passed to the delete hook like with Delete.
+// Returns true, if elem is in the tree afterwards. With EvictSmallest (EvictLargest), an element smaller (larger)
+// than all others is removed again right away.
+// Undo reverses the insert together with the eviction. If elem itself or more than one element was removed,
+// there is nothing to undo.
+// Runs in O(log(n))
+func (tree *Tree23) InsertBounded(elem TreeElement) bool {
+
+	if tree.maxLen <= 0 || tree.length < tree.maxLen {
+		return tree.insertChecked(elem, tree.key(elem), tree.unique, false)
+	}
+	if tree.evictPolicy == RejectWhenFull || !tree.insertChecked(elem, tree.key(elem), tree.unique, false) {
+		return false
+	}
+
+	l := tree.undoLeaf
+	kept := true
+	evictions := 0
+	for tree.length > tree.maxLen {
+		evicted := tree.minLeaf
+		if tree.evictPolicy == EvictLargest {
+			evicted = tree.treeNodes[evicted].prev
+		}
+		kept = kept && evicted != l
+		tree.DeleteNode(evicted)
+		evictions++
+	}
+
+	// Undo has to reverse the insert and the eviction together, like for UpdateKey.
+	if kept && evictions == 1 {
+		tree.undoOp = undoUpdate
+		tree.undoLeaf = l
+	} else {
+		tree.undoOp = 0
+		tree.undoElem = nil
+	}
+	return kept
+}
+
+// InsertTracked works like Insert, but returns true, if the memory of the tree had to grow for the insert.
+// Growing copies all nodes, which can cause a latency spike. Reserve can be used to grow at a better time.
+// Runs in O(log(n))
+func (tree *Tree23) InsertTracked(elem TreeElement) (grew bool) {
+	l := len(tree.treeNodes)
+	tree.Insert(elem)
+	return len(tree.treeNodes) != l
+}
+
+// Reserve grows the memory of the tree, so that at least n more nodes can be created without growing again.
+// A tree needs up to two nodes per element, so reserving 2*k nodes is enough for k inserts.
+// Runs in O(n)
+func (tree *Tree23) Reserve(n int) {
+	tree.beginMutation()
+	if missing := tree.treeNodesFirstFreePos + n - len(tree.treeNodes); missing > 0 {
+		tree.treeNodes = append(tree.treeNodes, make([]treeNode, missing)...)
+	}
+}
+
+// InsertFromChannel inserts all elements received from ch until ch is closed or done is closed.
+// It blocks until then. The tree is not safe for concurrent use, so the calling goroutine has to be the
+// only one using the tree until InsertFromChannel returns.
+// Runs in O(k log(n)) for k received elements
+func (tree *Tree23) InsertFromChannel(ch <-chan TreeElement, done <-chan struct{}) {
+	for {
+		select {
+		case <-done:
+			return
+		case e, ok := <-ch:
+			if !ok {
+				return
+			}
+			tree.Insert(e)
+		}
+	}
+}
+
+// InsertWithHint inserts a given element into the tree and returns the new leaf.
+// hint is the leaf, that elem is expected to follow, like the leaf returned by the previous call
+// when inserting in increasing order. If hint is the largest leaf and elem is not smaller,
+// elem is appended along the right border of the tree without comparing any values.
+// If elem fits between hint and the next leaf, it is inserted directly after hint, following the path to hint.
+// Otherwise InsertWithHint works exactly like Insert.
+// For a tree from NewSet, the existing leaf is returned if an equal element already exists.
+// The tree has no parent pointers, so the insert still has to descend from the root.
+// Runs in O(log(n))
+func (tree *Tree23) InsertWithHint(hint TreeNodeIndex, elem TreeElement) TreeNodeIndex {
+
+	tree.beginMutation()
+	if tree.unique {
+		if l := tree.findEqual(elem); l != -1 {
+			return l
+		}
+	}
+	tree.writeJournal(journalInsert, elem)
+
+	k := tree.key(elem)
+	appendLast, afterHint := false, false
+	if tree.isLeafNode(hint) {
+		// The leaf list only wraps around after the largest leaf.
+		// With equal values we can not tell and just use the normal insert.
+		v := tree.leafKey(hint)
+		next := tree.treeNodes[hint].next
+		// Elements with the same value might have to be ordered by the tie breaker.
+		appendLast = (next == hint || tree.leafKey(next) < v) && (v < k || v == k && tree.tieBreaker == nil)
+		// Equal elements have to stay next to each other, so an equal value only fits behind an equal element.
+		afterHint = !appendLast && next != tree.minLeaf && k < tree.leafKey(next) &&
+			(v < k || v == k && tree.tieBreaker == nil && elem.Equal(tree.treeNodes[hint].elem))
+	}
+	depth := tree.metricsDepth()
+	var l TreeNodeIndex
+	if afterHint {
+		l = tree.insertAfterLeaf(hint, elem, k)
+	} else {
+		l = tree.insert(elem, k, appendLast)
+	}
+	tree.undoLeaf = l
+	tree.undoOp = journalInsert
+	tree.checkInvariant("InsertWithHint", elem)
+	if tree.metrics != nil {
+		tree.metrics.ObserveInsert(depth)
+	}
+
+	if tree.onInsert != nil {
+		tree.onInsert(elem)
+	}
+	return l
+}
+
+// insert inserts a given element with the key k into the tree and returns the new leaf.
+// If appendLast is set, elem is inserted after the largest leaf without comparing any values.
+// Equal elements are always kept next to each other in the leaf list.
+// With a tie breaker, elem is inserted before the first leaf with the same value, that is larger than elem.
+func (tree *Tree23) insert(elem TreeElement, k float64, appendLast bool) TreeNodeIndex {
+
+	var l TreeNodeIndex
+	q := tree.firstLargerTie(elem, k, appendLast)
+	if q != -1 {
+		l = tree.insertBeforeLeaf(q, elem, k)
+	} else {
+		l = tree.insertLeaf(elem, &insertion{key: k, appendLast: appendLast, after: -1, before: -1})
+	}
+
+	if tree.length == 1 || k < tree.leafKey(tree.minLeaf) || q == tree.minLeaf {
+		tree.minLeaf = l
+	}
+	return l
+}
+
+// equalBefore returns the closest leaf equal to elem in front of the leaf p, if p is not equal to elem itself
+// and all leaves in between have the key k of elem. Otherwise or if p is -1, -1 is returned.
+func (tree *Tree23) equalBefore(p TreeNodeIndex, elem TreeElement, k float64) TreeNodeIndex {
+	if p == -1 || tree.leafKey(p) != k || elem.Equal(tree.treeNodes[p].elem) {
+		return -1
+	}
+	for p != tree.minLeaf {
+		p = tree.treeNodes[p].prev
+		if tree.leafKey(p) != k {
+			return -1
+		}
+		if elem.Equal(tree.treeNodes[p].elem) {
+			return p
+		}
+	}
+	return -1
+}
+
+// insertAfterLeaf inserts elem with the key k directly after the leaf p and returns the new leaf.
+// k must be between the values of p and the next leaf.
+func (tree *Tree23) insertAfterLeaf(p TreeNodeIndex, elem TreeElement, k float64) TreeNodeIndex {
+
+	var buf [maxPathLen]int
+	path, found := buf[:0], true
+	if p != tree.root {
+		path, found = tree.pathTo(tree.root, p, tree.leafKey(p), path)
+	}
+	// Without a way down to p, elem is inserted by its value.
+	if !found {
+		p = -1
+	}
+	return tree.insertLeaf(elem, &insertion{key: k, after: p, before: -1, path: path})
+}
+
+// firstLargerTie returns the first leaf with the key k, that is larger than elem according to the tie breaker.
+// -1 is returned, if there is no tie breaker, no such leaf or if appendLast is set.
+func (tree *Tree23) firstLargerTie(elem TreeElement, k float64, appendLast bool) TreeNodeIndex {
+	if tree.tieBreaker == nil || appendLast || tree.IsEmpty(tree.root) {
+		return -1
+	}
+	l, err := tree.findFirstLargerLeafRec(tree.root, k)
+	if err != nil {
+		return -1
+	}
+	for i := 0; i < tree.length && tree.leafKey(l) == k; i++ {
+		if tree.tieBreaker(elem, tree.treeNodes[l].elem) {
+			return l
+		}
+		l = tree.treeNodes[l].next
+	}
+	return -1
+}
+
+// insertBeforeLeaf inserts elem with the key k directly before the leaf q, which must have the same value,
+// and returns the new leaf.
+func (tree *Tree23) insertBeforeLeaf(q TreeNodeIndex, elem TreeElement, k float64) TreeNodeIndex {
+
+	var buf [maxPathLen]int
+	path, found := buf[:0], true
+	if q != tree.root {
+		path, found = tree.pathTo(tree.root, q, tree.leafKey(q), path)
+	}
+	if !found {
+		q = -1
+	}
+	return tree.insertLeaf(elem, &insertion{key: k, after: -1, before: q, path: path})
+}
+
+// insertLeaf inserts a given element into the tree as a new leaf and returns it.
+// See insertRec for the position of the new leaf.
+func (tree *Tree23) insertLeaf(elem TreeElement, ins *insertion) TreeNodeIndex {
+
+	tree.length++
 
 	// This can only happen on an empty tree.
 	if tree.IsEmpty(tree.root) {
-		l := tree.newLeaf(elem, -1, -1)
+		l := tree.newLeaf(elem, ins.key, -1, -1)
 		tree.treeNodes[l].prev = l
 		tree.treeNodes[l].next = l
 		tree.recycleNode(tree.root)
 		tree.root = l
-		return
+		return l
 	}
 
 	// This can only happen on a tree with just one leaf.
 	if tree.IsLeaf(tree.root) {
-		l := tree.newLeaf(elem, -1, -1)
+		l := tree.newLeaf(elem, ins.key, -1, -1)
 
-		if tree.treeNodes[l].elem.ExtractValue() < tree.treeNodes[tree.root].elem.ExtractValue() {
+		if ins.before == tree.root || !ins.appendLast && ins.after != tree.root && tree.leafKey(l) < tree.leafKey(tree.root) {
 			tree.treeNodes[l].prev = tree.treeNodes[tree.root].prev
 			tree.treeNodes[tree.treeNodes[l].prev].next = l
 			tree.treeNodes[l].next = tree.root
@@ -430,11 +1247,16 @@ func (tree *Tree23) Insert(elem TreeElement) {
 			tree.treeNodes[tree.root].next = l
 			tree.root = tree.distributeTwoChildren(tree.root, l)
 		}
-		return
+		return l
 	}
 
-	subTree := tree.insertInto(tree.root, elem)
-	newChildren := tree.insertRec(tree.treeNodes[tree.root].children[subTree].child, elem)
+	subTree := tree.insertPosition(tree.root, ins, 0)
+	newChildren, leaf := tree.insertRec(tree.treeNodes[tree.root].children[subTree].child, elem, ins, 1)
+	if newChildren == nil {
+		// An equal element is further in front, so elem belongs directly behind it.
+		tree.length--
+		return tree.insertAfterLeaf(leaf, elem, ins.key)
+	}
 
 	//fmt.Println(*newChildren)
 
@@ -442,7 +1264,7 @@ func (tree *Tree23) Insert(elem TreeElement) {
 	if len(*newChildren) == 1 {
 		tree.treeNodes[tree.root].children[subTree].maxChild = tree.max((*newChildren)[0])
 		tree.treeNodes[tree.root].children[subTree].child = (*newChildren)[0]
-		return
+		return leaf
 	}
 
 	// We get two new children and have one old (subTree is overwritten!)
@@ -463,9 +1285,10 @@ func (tree *Tree23) Insert(elem TreeElement) {
 			tree.treeNodes[tree.root].children[2].child = (*newChildren)[1]
 		}
 
-		return
+		return leaf
 	}
 
+	tree.splits++
 	oldRoot := tree.root
 	defer tree.recycleNode(oldRoot)
 
@@ -479,6 +1302,17 @@ func (tree *Tree23) Insert(elem TreeElement) {
 		tree.root = tree.distributeFourChildren(tree.treeNodes[tree.root].children[0].child, tree.treeNodes[tree.root].children[1].child, (*newChildren)[0], (*newChildren)[1])
 	}
 
+	return leaf
+}
+
+// height returns the number of levels below t. A leaf has a height of 0.
+func (tree *Tree23) height(t TreeNodeIndex) int {
+	h := 0
+	for !tree.IsLeaf(t) {
+		t = tree.treeNodes[t].children[0].child
+		h++
+	}
+	return h
 }
 
 // deleteFrom returns the index of the child elem must be in (if any)
@@ -493,9 +1327,19 @@ func (tree *Tree23) deleteFrom(t TreeNodeIndex, v float64) int {
 	return -1
 }
 
-// deleteRec is the recursive function to delete elem in t.
-// Returns a list of trees that are all on one level.
-func (tree *Tree23) deleteRec(t TreeNodeIndex, elem TreeElement) *[]TreeNodeIndex {
+// deleteMatch returns true, if the leaf l should be deleted. This is the specific leaf leaf
+// or, if it is -1, any leaf equal to elem.
+func (tree *Tree23) deleteMatch(l TreeNodeIndex, elem TreeElement, leaf TreeNodeIndex) bool {
+	if leaf != -1 {
+		return l == leaf
+	}
+	return elem.Equal(tree.treeNodes[l].elem)
+}
+
+// deleteRec is the recursive function to delete elem in t on the given depth.
+// If a specific leaf is deleted (leaf is not -1), the way down is taken from path.
+// Returns a list of trees that are all on one level and the removed element or nil, if nothing was removed.
+func (tree *Tree23) deleteRec(t TreeNodeIndex, elem TreeElement, leaf TreeNodeIndex, path []int, depth int) (*[]TreeNodeIndex, TreeElement) {
 	allLeaves := true
 
 	leafCount := 0
@@ -504,7 +1348,7 @@ func (tree *Tree23) deleteRec(t TreeNodeIndex, elem TreeElement) *[]TreeNodeInde
 		c := tree.treeNodes[t].children[i]
 		isLeaf := tree.IsLeaf(c.child)
 		allLeaves = allLeaves && isLeaf
-		if isLeaf && (foundLeaf || !elem.Equal(tree.treeNodes[c.child].elem)) {
+		if isLeaf && (foundLeaf || !tree.deleteMatch(c.child, elem, leaf)) {
 			leafCount++
 		} else {
 			// We only want to delete one node, that is equal to elem!
@@ -526,16 +1370,21 @@ func (tree *Tree23) deleteRec(t TreeNodeIndex, elem TreeElement) *[]TreeNodeInde
 			newChildren = &tree.threeElemTreeList
 		}
 
+		var removed TreeElement
 		index := 0
 		foundLeaf = false
 		for i := 0; i < tree.treeNodes[t].cCount; i++ {
 			c := tree.treeNodes[t].children[i]
 			// Remove the child that contains our element!
-			if foundLeaf || !elem.Equal(tree.treeNodes[c.child].elem) {
+			if foundLeaf || !tree.deleteMatch(c.child, elem, leaf) {
 				(*newChildren)[index] = c.child
 				index++
 			} else {
 				foundLeaf = true
+				removed = tree.treeNodes[c.child].elem
+				if c.child == tree.minLeaf {
+					tree.minLeaf = tree.treeNodes[c.child].next
+				}
 				tree.treeNodes[tree.treeNodes[c.child].prev].next = tree.treeNodes[c.child].next
 				tree.treeNodes[tree.treeNodes[c.child].next].prev = tree.treeNodes[c.child].prev
 
@@ -544,10 +1393,15 @@ func (tree *Tree23) deleteRec(t TreeNodeIndex, elem TreeElement) *[]TreeNodeInde
 			}
 		}
 
-		return newChildren
+		return newChildren, removed
 	}
 
-	deleteFrom := tree.deleteFrom(t, elem.ExtractValue())
+	var deleteFrom int
+	if leaf != -1 {
+		deleteFrom = path[depth]
+	} else {
+		deleteFrom = tree.deleteFrom(t, tree.key(elem))
+	}
 	// In case we don't find an element to delete, we just return our own children.
 	// Let's get things sorted out some other recursion level.
 	// No node recycling possible here.
@@ -559,17 +1413,17 @@ func (tree *Tree23) deleteRec(t TreeNodeIndex, elem TreeElement) *[]TreeNodeInde
 		case 2:
 			tree.twoElemTreeList[0] = tree.treeNodes[t].children[0].child
 			tree.twoElemTreeList[1] = tree.treeNodes[t].children[1].child
-			return &tree.twoElemTreeList
+			return &tree.twoElemTreeList, nil
 		case 3:
 			tree.threeElemTreeList[0] = tree.treeNodes[t].children[0].child
 			tree.threeElemTreeList[1] = tree.treeNodes[t].children[1].child
 			tree.threeElemTreeList[2] = tree.treeNodes[t].children[2].child
-			return &tree.threeElemTreeList
+			return &tree.threeElemTreeList, nil
 		}
 	}
 
 	// The new children from the subtree that does not contain elem any more!
-	children := tree.deleteRec(tree.treeNodes[t].children[deleteFrom].child, elem)
+	children, removed := tree.deleteRec(tree.treeNodes[t].children[deleteFrom].child, elem, leaf, path, depth+1)
 
 	// Count the number of old grandChildren before allocating
 	oGCCount := 0
@@ -608,302 +1462,3306 @@ func (tree *Tree23) deleteRec(t TreeNodeIndex, elem TreeElement) *[]TreeNodeInde
 
 	//defer tree.recycleNode(t)
 
-	return tree.multipleNodesFromChildrenList(&tree.nineElemTreeList, oGCCount+len(*children))
+	newChildren := tree.multipleNodesFromChildrenList(&tree.nineElemTreeList, oGCCount+len(*children))
+	// All children of t that are not needed anymore were merged into the others.
+	if merged := tree.treeNodes[t].cCount - len(*newChildren); merged > 0 {
+		tree.merges += int64(merged)
+	}
+	return newChildren, removed
 }
 
 // Delete removes an element in the tree, if it exists. It will not throw any errors, if the element doesn't exist.
 // Runs in O(log(n))
 func (tree *Tree23) Delete(elem TreeElement) {
 
-	if tree.IsEmpty(tree.root) {
+	tree.beginMutation()
+	tree.writeJournal(journalDelete, elem)
+
+	depth := tree.metricsDepth()
+	removed := tree.delete(elem)
+	tree.repairLeafList("Delete", elem)
+	tree.checkInvariant("Delete", elem)
+	if tree.metrics != nil {
+		tree.metrics.ObserveDelete(depth)
+	}
+	if removed == nil {
 		return
 	}
+	tree.setUndoDelete(removed, tree.key(elem))
 
-	if tree.IsLeaf(tree.root) && elem.Equal(tree.treeNodes[tree.root].elem) {
-		tree.treeNodes[tree.root].next = -1
-		tree.treeNodes[tree.root].prev = -1
-		tree.treeNodes[tree.root].elem = nil
-		return
+	if tree.onDelete != nil {
+		tree.onDelete(removed)
 	}
+}
 
-	children := tree.deleteRec(tree.root, elem)
+// delete removes one element equal to elem from the tree and returns the removed element.
+// nil is returned, if there is no such element in the tree.
+func (tree *Tree23) delete(elem TreeElement) TreeElement {
 
-	defer tree.recycleNode(tree.root)
+	if tree.IsEmpty(tree.root) {
+		return nil
+	}
 
-	if len(*children) == 1 {
-		tree.root = (*children)[0]
-		return
+	// This can only happen on a tree with just one leaf.
+	if tree.IsLeaf(tree.root) {
+		if !elem.Equal(tree.treeNodes[tree.root].elem) {
+			return nil
+		}
+		return tree.deleteRoot()
 	}
 
-	tree.root = tree.nodeFromChildrenList(children, 0, len(*children))
-}
+	// elem is bigger than every element in the tree. So it can not be in there.
+	if tree.key(elem) > tree.max(tree.root) {
+		return nil
+	}
 
-// findRec is the recursive function for finding elem in t.
-// It returns the tree node (index) or an error if not found.
-func (tree *Tree23) findRec(t TreeNodeIndex, elem TreeElement) (TreeNodeIndex, error) {
-	if tree.IsLeaf(t) {
-		if elem.Equal(tree.treeNodes[t].elem) {
-			return t, nil
+	removed := tree.deleteFromRoot(elem, -1, nil)
+	if removed == nil {
+		// Elements with the same value can be spread over multiple subtrees.
+		if l := tree.findEqual(elem); l != -1 {
+			removed = tree.deleteNode(l)
 		}
-		return -1, errors.New("TreeElement can not be found in the tree1.")
 	}
+	return removed
+}
 
-	subTree := tree.deleteFrom(t, elem.ExtractValue())
-	if subTree == -1 {
-		return -1, errors.New("TreeElement can not be found in the tree.")
+// deleteNode removes the leaf l from the tree and returns the removed element.
+// l must be a leaf in the tree. nil is returned, if l can not be reached from the root.
+func (tree *Tree23) deleteNode(l TreeNodeIndex) TreeElement {
+
+	if l == tree.root {
+		return tree.deleteRoot()
 	}
 
-	return tree.findRec(tree.treeNodes[t].children[subTree].child, elem)
+	var buf [maxPathLen]int
+	path, found := tree.pathTo(tree.root, l, tree.leafKey(l), buf[:0])
+	if !found {
+		return nil
+	}
+	return tree.deleteFromRoot(tree.treeNodes[l].elem, l, path)
 }
 
-// Find tries to find the leaf node with the given element in t.
-// If found, it will return the leaf node. Otherwise generated an error accordingly.
-// Runs in O(log(n))
-func (tree *Tree23) Find(elem TreeElement) (TreeNodeIndex, error) {
-	if tree.IsEmpty(tree.root) {
-		return -1, errors.New("Tree is empty. No elements can be found.")
+// deleteRoot removes the only leaf of the tree, which is the root itself, and returns its element.
+func (tree *Tree23) deleteRoot() TreeElement {
+	removed := tree.treeNodes[tree.root].elem
+	tree.minLeaf = -1
+	tree.treeNodes[tree.root].next = -1
+	tree.treeNodes[tree.root].prev = -1
+	tree.treeNodes[tree.root].elem = nil
+	tree.length--
+	return removed
+}
+
+// deleteFromRoot deletes elem (or the leaf leaf with the way down path, if it is not -1) from a root with children
+// and returns the removed element.
+func (tree *Tree23) deleteFromRoot(elem TreeElement, leaf TreeNodeIndex, path []int) TreeElement {
+
+	children, removed := tree.deleteRec(tree.root, elem, leaf, path, 0)
+	if removed != nil {
+		tree.length--
 	}
-	return tree.findRec(tree.root, elem)
+
+	oldRoot := tree.root
+	if len(*children) == 1 {
+		tree.root = (*children)[0]
+	} else {
+		tree.root = tree.nodeFromChildrenList(children, 0, len(*children))
+	}
+	tree.recycleNode(oldRoot)
+
+	return removed
 }
 
-// findFirstLargerLeafRec is the recursive function for finding the smallest node bigger than value v in t.
-func (tree *Tree23) findFirstLargerLeafRec(t TreeNodeIndex, v float64) (TreeNodeIndex, error) {
+// maxPathLen is the height of a tree, up to which the way down to a leaf fits into a buffer on the stack.
+const maxPathLen = 40
+
+// pathTo searches the leaf l with a value of v in the subtree t. The positions of all children on the
+// way down are appended to path. Multiple subtrees are searched, if they all contain the value v.
+// Returns the extended path and true, if l was found.
+func (tree *Tree23) pathTo(t, l TreeNodeIndex, v float64, path []int) ([]int, bool) {
 	if tree.IsLeaf(t) {
-		if v <= tree.treeNodes[t].elem.ExtractValue() {
-			return t, nil
-		}
-		return -1, errors.New("TreeElement can not be found in the tree.")
+		return path, t == l
 	}
 
-	subTree := tree.deleteFrom(t, v)
-	if subTree == -1 {
-		return -1, errors.New("TreeElement can not be found in the tree.")
+	for i := 0; i < tree.treeNodes[t].cCount; i++ {
+		if v > tree.treeNodes[t].children[i].maxChild {
+			continue
+		}
+		// All remaining children only contain bigger values.
+		if i > 0 && tree.treeNodes[t].children[i-1].maxChild > v {
+			break
+		}
+		var found bool
+		if path, found = tree.pathTo(tree.treeNodes[t].children[i].child, l, v, append(path, i)); found {
+			return path, true
+		}
+		path = path[:len(path)-1]
 	}
+	return path, false
+}
 
-	return tree.findFirstLargerLeafRec(tree.treeNodes[t].children[subTree].child, v)
+// isLeafNode returns true, if t is a leaf with an element in the tree.
+func (tree *Tree23) isLeafNode(t TreeNodeIndex) bool {
+	return t >= 0 && int(t) < tree.treeNodesFirstFreePos && tree.IsLeaf(t) && tree.treeNodes[t].elem != nil
 }
 
-// FindFirstLargerLeaf returns the smallest leaf with a value bigger than v!
-// If there is no such element, an error is returned ()
-// Runs in O(log(n))
-func (tree *Tree23) FindFirstLargerLeaf(v float64) (TreeNodeIndex, error) {
-	if tree.IsEmpty(tree.root) {
-		return -1, errors.New("Tree is empty. No elements can be found.")
+// DeleteSlice deletes all given elements from the tree and returns the number of actually deleted elements.
+// elems must be sorted in the order of the tree (ascending, unless the tree is from NewDescending).
+// Elements that are not in the tree are skipped. An element given k times deletes up to k equal elements.
+// For a few elements, every element is removed like with Delete. For many elements, the leaf list and elems
+// are walked once together and the tree is rebuilt from the remaining elements. All leaf indices are invalid
+// afterwards in that case. DeleteSlice can not be undone.
+// Runs in O(min(k log(n), n + k))
+func (tree *Tree23) DeleteSlice(elems []TreeElement) int {
+
+	tree.beginMutation()
+
+	if tree.IsEmpty(tree.root) || len(elems) == 0 {
+		return 0
 	}
 
-	return tree.findFirstLargerLeafRec(tree.root, v)
-}
+	// Deleting single elements is faster, as long as only a few are deleted.
+	if len(elems)*bits.Len(uint(tree.length)) <= tree.length {
+		before := tree.length
+		for _, e := range elems {
+			tree.Delete(e)
+		}
+		// Like the rebuild below, the whole batch can not be undone.
+		tree.undoOp = 0
+		tree.undoElem = nil
+		return before - tree.length
+	}
 
-// Previous returns the previous leaf node that is smaller or equal than itself.
-// For the smallest/first node in the tree, Previous will return the biggest/last node!
-// Previous only works for leaf nodes and will generate an error otherwise.
-// Runs in O(1)
-func (tree *Tree23) Previous(t TreeNodeIndex) (TreeNodeIndex, error) {
-	if tree.IsEmpty(t) {
-		return -1, errors.New("Previous() does not work for empty trees")
+	all := tree.LeafIndices()
+	survivors := make([]TreeElement, 0, len(all))
+	survivorKeys := make([]float64, 0, len(all))
+	var removed []TreeElement
+
+	for i, j := 0, 0; i < len(all); {
+		k := tree.leafKey(all[i])
+		for j < len(elems) && tree.key(elems[j]) < k {
+			j++
+		}
+		end := i
+		for end < len(all) && tree.leafKey(all[end]) == k {
+			end++
+		}
+		jEnd := j
+		for jEnd < len(elems) && tree.key(elems[jEnd]) == k {
+			jEnd++
+		}
+
+		// Match the run of equal values in the tree with the run of equal values in elems.
+		run := all[i:end]
+		for _, e := range elems[j:jEnd] {
+			for x := range run {
+				if run[x] != -1 && e.Equal(tree.treeNodes[run[x]].elem) {
+					removed = append(removed, tree.treeNodes[run[x]].elem)
+					run[x] = -1
+					break
+				}
+			}
+		}
+		for _, l := range run {
+			if l != -1 {
+				survivors = append(survivors, tree.treeNodes[l].elem)
+				survivorKeys = append(survivorKeys, k)
+			}
+		}
+		i, j = end, jEnd
 	}
-	if tree.IsLeaf(t) {
-		return tree.treeNodes[t].prev, nil
+
+	if len(removed) == 0 {
+		return 0
 	}
-	return -1, errors.New("Previous() only works for leaf nodes!")
-}
 
-// Next returns the next leaf node that is bigger or equal than itself.
-// For the biggest/last node in the tree, Next will return the smallest/first node!
-// Next only works for leaf nodes and will generated an error otherwise.
-// Runs in O(1)
-func (tree *Tree23) Next(t TreeNodeIndex) (TreeNodeIndex, error) {
-	if tree.IsEmpty(t) {
-		return -1, errors.New("Next() does not work for empty trees")
+	for _, e := range removed {
+		tree.writeJournal(journalDelete, e)
 	}
-	if tree.IsLeaf(t) {
-		return tree.treeNodes[t].next, nil
+	tree.reset()
+	tree.buildSorted(survivors, survivorKeys)
+
+	if tree.onDelete != nil {
+		for _, e := range removed {
+			tree.onDelete(e)
+		}
 	}
-	return -1, errors.New("Next() only works for leaf nodes!")
+	return len(removed)
 }
 
-// minmaxDepth returns the minimum and maximum depth of all children (recursively) of t.
-func (tree *Tree23) minmaxDepth(t TreeNodeIndex) (int, int) {
-	if tree.IsEmpty(t) {
-		return 0, 0
-	}
-	if tree.IsLeaf(t) {
-		return 1, 1
+// Trim removes all elements with a value smaller than low or larger than high and returns the number of removed elements.
+// The leaf list is walked once and the tree is rebuilt from the remaining elements, so leaf indices change,
+// if anything is removed. All removed elements are journaled and passed to the delete hook.
+// Runs in O(n)
+func (tree *Tree23) Trim(low, high float64) int {
+
+	tree.beginMutation()
+
+	lowKey, highKey := tree.keyOf(low), tree.keyOf(high)
+	if tree.descending {
+		lowKey, highKey = highKey, lowKey
 	}
-	depthMin := -1
-	depthMax := -1
 
-	for i := 0; i < tree.treeNodes[t].cCount; i++ {
-		c := tree.treeNodes[t].children[i]
-		min, max := tree.minmaxDepth(c.child)
-		if depthMin == -1 || min < depthMin {
-			depthMin = min + 1
+	all := tree.LeafIndices()
+	survivors := make([]TreeElement, 0, len(all))
+	survivorKeys := make([]float64, 0, len(all))
+	var removed []TreeElement
+	for _, l := range all {
+		if k := tree.leafKey(l); k >= lowKey && k <= highKey {
+			survivors = append(survivors, tree.treeNodes[l].elem)
+			survivorKeys = append(survivorKeys, k)
+		} else {
+			removed = append(removed, tree.treeNodes[l].elem)
 		}
-		if depthMax == -1 || max > depthMax {
-			depthMax = max + 1
+	}
+
+	if len(removed) == 0 {
+		return 0
+	}
+
+	for _, e := range removed {
+		tree.writeJournal(journalDelete, e)
+	}
+	tree.reset()
+	tree.buildSorted(survivors, survivorKeys)
+
+	if tree.onDelete != nil {
+		for _, e := range removed {
+			tree.onDelete(e)
 		}
 	}
-	return depthMin, depthMax
+	return len(removed)
 }
 
-// Depths returns the minimum and maximum depth of the tree t.
-// minimum and maximum should always be the same ()
-// Runs in O(log(n))
-func (tree *Tree23) Depths() (int, int) {
-	return tree.minmaxDepth(tree.root)
-}
+// TransformRange replaces every element with a value within [low, high] by the result of f and returns
+// the number of transformed elements. Each element is deleted and the result of f inserted again,
+// so f may change the value arbitrarily and results can move outside of [low, high].
+// Transformed elements are not visited a second time. The tree stays valid after every single step.
+// Runs in O(k log(n)) for k elements within [low, high]
+func (tree *Tree23) TransformRange(low, high float64, f func(TreeElement) TreeElement) int {
 
-// getSmallestLeafRec is the recursive function that returns the left-most leaf node.
-func (tree *Tree23) getSmallestLeafRec(t TreeNodeIndex) (TreeNodeIndex, error) {
-	if tree.IsLeaf(t) {
-		return t, nil
+	tree.beginMutation()
+
+	// Leaf indices stay valid while other leaves are deleted or inserted.
+	var leaves []TreeNodeIndex
+	tree.walkRange(low, high, func(l TreeNodeIndex) bool {
+		leaves = append(leaves, l)
+		return true
+	})
+
+	for _, l := range leaves {
+		elem := tree.treeNodes[l].elem
+		tree.DeleteNode(l)
+		tree.Insert(f(elem))
 	}
-	return tree.getSmallestLeafRec(tree.treeNodes[t].children[0].child)
+	return len(leaves)
 }
 
-// GetSmallestLeaf returns the leaf node of the smallest element in t
-// or sets an error if the tree is empty.
-// Runs in O(log(n))
-func (tree *Tree23) GetSmallestLeaf() (TreeNodeIndex, error) {
+// Dedup reduces every run of equal elements to a single element and returns the number of removed elements.
+// The elements of a run are combined by keep in sorted order, which must return an element equal to both a and b.
+// The first leaf of every run stays in the tree and gets the combined element like with ChangeValue.
+// All other leaves of the run are removed like with DeleteNode. It is the tree version of slices.Compact.
+// An error is returned and nothing changes, if keep returns an element that is not equal to the run.
+// Runs in O(n + k log(n)) for k removed elements
+func (tree *Tree23) Dedup(keep func(a, b TreeElement) TreeElement) (int, error) {
+
+	tree.beginMutation()
 	if tree.IsEmpty(tree.root) {
-		return -1, errors.New("No leaf for an empty tree")
+		return 0, nil
 	}
-	return tree.getSmallestLeafRec(tree.root)
-}
 
-// GetLargestLeaf returns the leaf node of the largest element in t
-// or sets an error if the tree is empty.
-// Runs in O(log(n))
-func (tree *Tree23) GetLargestLeaf() (TreeNodeIndex, error) {
-	l, err := tree.GetSmallestLeaf()
-	if err != nil {
-		return -1, err
+	// All runs are found before anything is removed, as leaf indices stay valid while deleting other leaves.
+	var firsts []TreeNodeIndex
+	var kept []TreeElement
+	var duplicates []TreeNodeIndex
+	for l := tree.minLeaf; ; {
+		elem := tree.treeNodes[l].elem
+		combined := elem
+		next := tree.treeNodes[l].next
+		for next != tree.minLeaf && elem.Equal(tree.treeNodes[next].elem) {
+			combined = keep(combined, tree.treeNodes[next].elem)
+			if !elem.Equal(combined) {
+				return 0, errors.New("Dedup() needs keep to return an element equal to the run")
+			}
+			duplicates = append(duplicates, next)
+			next = tree.treeNodes[next].next
+		}
+		if next != tree.treeNodes[l].next {
+			firsts = append(firsts, l)
+			kept = append(kept, combined)
+		}
+		if next == tree.minLeaf {
+			break
+		}
+		l = next
 	}
 
-	return tree.Previous(l)
+	for i, l := range firsts {
+		tree.ChangeValue(l, kept[i])
+	}
+	for _, l := range duplicates {
+		tree.DeleteNode(l)
+	}
+	return len(duplicates), nil
 }
 
-// checkLinkedList is the recursive function that runs through all leaf nodes by using
-// the provided prev/next pointers and checks them on validity until it reaches the start node again.
-func (tree *Tree23) checkLinkedList(startNode, currentNode TreeNodeIndex) bool {
+// DeleteNode removes the leaf t from the tree. Other than Delete, this removes exactly this leaf
+// and not just any leaf with an equal element.
+// An error is returned, if t is not a leaf in the tree.
+// Runs in O(log(n)), if only a few elements share the same value
+func (tree *Tree23) DeleteNode(t TreeNodeIndex) error {
 
-	nextNode := tree.treeNodes[currentNode].next
-	linkCheck := tree.treeNodes[nextNode].prev == currentNode
+	tree.beginMutation()
 
-	// Once all around.
-	if startNode == nextNode {
-		return linkCheck
+	if !tree.isLeafNode(t) {
+		return errors.New("DeleteNode() only works for leaf nodes in the tree")
 	}
 
-	increasing := tree.treeNodes[nextNode].elem.ExtractValue() >= tree.treeNodes[currentNode].elem.ExtractValue()
+	elem := tree.treeNodes[t].elem
+	k := tree.leafKey(t)
+	tree.writeJournal(journalDelete, elem)
 
-	return linkCheck && increasing && tree.checkLinkedList(startNode, nextNode)
+	depth := tree.metricsDepth()
+	removed := tree.deleteNode(t)
+	if removed == nil {
+		return errors.New("DeleteNode() only works for leaf nodes in the tree")
+	}
+	tree.repairLeafList("DeleteNode", removed)
+	tree.checkInvariant("DeleteNode", removed)
+	if tree.metrics != nil {
+		tree.metrics.ObserveDelete(depth)
+	}
+	tree.setUndoDelete(removed, k)
+
+	if tree.onDelete != nil {
+		tree.onDelete(removed)
+	}
+	return nil
 }
 
-// leafListInvariant checks, that there are no dangling pointers and all elements are sorted increasingly!
-func (tree *Tree23) leafListInvariant() bool {
+// setUndoDelete records the deleted element elem with the key k for Undo.
+func (tree *Tree23) setUndoDelete(elem TreeElement, k float64) {
+	tree.undoOp = journalDelete
+	tree.undoElem = elem
+	tree.undoKey = k
+}
 
-	if tree.IsEmpty(tree.root) {
-		return true
+// Undo reverses the last Insert or Delete (including their variants like InsertWithKey or DeleteNode) or UpdateKey,
+// if the tree was not modified in any other way since. An undone insert removes exactly the inserted leaf,
+// an undone delete inserts the deleted element again and an undone UpdateKey does both. Only the last operation can be undone,
+// Undo itself can not be undone. Like every other modification, it is journaled and calls the hooks.
+// Returns false, if there is nothing to undo.
+// Runs in O(log(n))
+func (tree *Tree23) Undo() bool {
+	op, elem, k, leaf := tree.undoOp, tree.undoElem, tree.undoKey, tree.undoLeaf
+
+	switch op {
+	case journalInsert:
+		tree.DeleteNode(leaf)
+	case journalDelete:
+		tree.insertChecked(elem, k, false, false)
+	case undoUpdate:
+		tree.DeleteNode(leaf)
+		tree.insertChecked(elem, k, false, false)
+	default:
+		return false
 	}
-
-	startNode, _ := tree.GetSmallestLeaf()
-	return tree.checkLinkedList(startNode, startNode)
+	tree.undoOp = 0
+	tree.undoElem = nil
+	return true
 }
 
-// memoryCheckRec recursively runs through the whole tree and fills s with usage info.
-func (tree *Tree23) preallocatedMemoryCheckRec(s *[]bool, t TreeNodeIndex) {
+// SetHooks sets callbacks that are called once for every element that is inserted into or deleted from the tree.
+// onInsert is called after the new leaf is in the tree, onDelete after the leaf is removed and gets the removed element.
+// Deleting an element that does not exist does not call onDelete. Either callback can be nil.
+// The callbacks must not modify the tree.
+func (tree *Tree23) SetHooks(onInsert, onDelete func(TreeElement)) {
+	tree.onInsert = onInsert
+	tree.onDelete = onDelete
+}
 
-	// We don't need recursive ending, because there will be no children anyway.
-	(*s)[t] = true
-	for i := 0; i < tree.treeNodes[t].cCount; i++ {
-		tree.preallocatedMemoryCheckRec(s, tree.treeNodes[t].children[i].child)
-	}
+// Metrics receives information about single operations on a tree. See SetMetrics.
+// depth is the number of levels, that were descended from the root to the leaves.
+type Metrics interface {
+	ObserveInsert(depth int)
+	ObserveDelete(depth int)
+	ObserveFind(depth int, found bool)
+}
 
+// SetMetrics sets a sink, that is called once for every Insert, Delete and Find (including their variants
+// like InsertWithKey or DeleteNode). Find also reports, if the element was found. A nil sink disables the metrics.
+// Bulk operations like Replace or DeleteSlice are not reported. The sink must not modify the tree.
+func (tree *Tree23) SetMetrics(m Metrics) {
+	tree.metrics = m
 }
 
-// cachedMemoryCheck runs though memory cache and fills s with usage info
-func (tree *Tree23) cachedMemoryCheck(s *[]bool) {
-	for _, n := range tree.treeNodesFreePositions {
-		(*s)[n] = true
+// metricsDepth returns the height of the tree, if a metrics sink is set. Otherwise 0 is returned without any work.
+func (tree *Tree23) metricsDepth() int {
+	if tree.metrics == nil {
+		return 0
 	}
+	return tree.height(tree.root)
 }
 
-// memoryCheck goes through all preallocated memory and checks, wether it is actually in use or unrachable
-// Returns true, if everything is OK.
-func (tree *Tree23) memoryCheck() bool {
-
-	// Should be initialized as false.
-	s := make([]bool, tree.treeNodesFirstFreePos, tree.treeNodesFirstFreePos)
+// Record types of the journal.
+const (
+	journalInsert byte = 'I'
+	journalDelete byte = 'D'
+	// The modeFlags of the tree. Written by SetJournal and whenever the mode changes.
+	journalMode byte = 'M'
+)
 
-	tree.preallocatedMemoryCheckRec(&s, tree.root)
-	tree.cachedMemoryCheck(&s)
+// undoUpdate marks an UpdateKey or an evicting InsertBounded as the last operation for Undo. It is never written to the journal.
+const undoUpdate byte = 'U'
+
+// SetJournal sets a writer that records every Insert and Delete before it is applied to the tree.
+// Each record consists of one byte for the operation, the length of the encoded element as uvarint
+// and the element encoded with its MarshalBinary method. Elements have to implement encoding.BinaryMarshaler.
+// The first record is the mode of the tree (NewDescending, NewSet), so Replay creates a tree of the same kind.
+// The journal is append-only and can be read back with Replay. A nil writer disables the journal.
+// Only operations that add or remove elements are recorded, not the in-place edits of ChangeValue.
+// A tie breaker can not be recorded and has to be set again after Replay.
+func (tree *Tree23) SetJournal(w io.Writer) {
+	tree.journal = w
+	tree.journalErr = nil
+	tree.writeJournalMode()
+}
 
-	allMemoryReachable := true
-	for _, n := range s {
-		allMemoryReachable = allMemoryReachable && n
+// modeFlags returns the mode of the tree as bit flags: 1 for NewDescending and 2 for NewSet.
+func (tree *Tree23) modeFlags() byte {
+	var flags byte
+	if tree.descending {
+		flags |= 1
 	}
+	if tree.unique {
+		flags |= 2
+	}
+	return flags
+}
 
-	return allMemoryReachable
-
+// setModeFlags sets the mode of the tree from flags of modeFlags.
+func (tree *Tree23) setModeFlags(flags byte) {
+	tree.descending = flags&1 != 0
+	tree.unique = flags&2 != 0
 }
 
-// Invariant checks the tree on validity.
-// Returns true, if everything is OK with the given tree.
-// Two things are checked: If the minimum and maximum depth is equal for every node up to the root.
-// Further, the linked list for the leaf nodes is checked for valid increasing order and linking
-// Including the link from the last to the first element.
-// Runs in O(n)
-func (tree *Tree23) Invariant() bool {
-	depthMin, depthMax := tree.Depths()
+// JournalErr returns the first error that occurred while writing to the journal.
+// After an error, no further records are written until SetJournal is called again.
+func (tree *Tree23) JournalErr() error {
+	return tree.journalErr
+}
 
-	linkedListCorrect := tree.leafListInvariant()
+// writeJournal appends a record of op for elem to the journal, if there is one.
+func (tree *Tree23) writeJournal(op byte, elem TreeElement) {
+	if tree.journal == nil || tree.journalErr != nil {
+		return
+	}
 
-	return depthMin == depthMax && linkedListCorrect && tree.memoryCheck()
+	m, ok := elem.(encoding.BinaryMarshaler)
+	if !ok {
+		tree.journalErr = errors.New("TreeElement does not implement encoding.BinaryMarshaler")
+		return
+	}
+	data, err := m.MarshalBinary()
+	if err != nil {
+		tree.journalErr = err
+		return
+	}
+	tree.writeJournalRecord(op, data)
 }
 
-// pprint recursively pretty prints the tree.
-func (tree *Tree23) pprint(t TreeNodeIndex, indentation int) {
-
-	if tree.IsEmpty(t) {
+// writeJournalMode appends a record with the mode of the tree to the journal, if there is one.
+func (tree *Tree23) writeJournalMode() {
+	if tree.journal == nil || tree.journalErr != nil {
 		return
 	}
+	tree.writeJournalRecord(journalMode, []byte{tree.modeFlags()})
+}
 
-	if tree.IsLeaf(t) {
-		if indentation != 0 {
-			fmt.Printf("  ")
+// writeJournalRecord appends one record of op with data to the journal.
+func (tree *Tree23) writeJournalRecord(op byte, data []byte) {
+	tree.journalBuf = append(tree.journalBuf[:0], op)
+	tree.journalBuf = binary.AppendUvarint(tree.journalBuf, uint64(len(data)))
+	tree.journalBuf = append(tree.journalBuf, data...)
+	_, tree.journalErr = tree.journal.Write(tree.journalBuf)
+}
+
+// Replay creates a new tree by applying all records of a journal written by SetJournal.
+// makeElem creates an element from its binary encoding. The tree gets the mode recorded in the journal.
+// An error is returned for unknown or incomplete records and for a change of the mode while the tree is not empty.
+// Runs in O(k log(n)) for k records
+func Replay(r io.Reader, makeElem func([]byte) TreeElement) (*Tree23, error) {
+
+	br := bufio.NewReader(r)
+	tree := New()
+
+	for {
+		op, err := br.ReadByte()
+		if err == io.EOF {
+			return tree, nil
 		}
-		for i := 0; i < indentation-1; i++ {
-			fmt.Printf("|  ")
+		if err != nil {
+			return nil, err
 		}
-		fmt.Printf("|")
-		fmt.Printf("--(prev: %.2f. value: %.2f. next: %.2f)\n",
-			tree.treeNodes[tree.treeNodes[t].prev].elem.ExtractValue(),
-			tree.treeNodes[t].elem.ExtractValue(),
-			tree.treeNodes[tree.treeNodes[t].next].elem.ExtractValue())
-		return
-	}
 
-	for i := 0; i < tree.treeNodes[t].cCount; i++ {
-		c := tree.treeNodes[t].children[i]
-		if indentation != 0 {
-			fmt.Printf("  ")
+		size, err := binary.ReadUvarint(br)
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
 		}
-		for i := 0; i < indentation-1; i++ {
-			fmt.Printf("|  ")
+		if err != nil {
+			return nil, err
+		}
+		data := make([]byte, size)
+		if _, err := io.ReadFull(br, data); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
 		}
-		if indentation != 0 {
-			fmt.Printf("|")
+
+		switch op {
+		case journalInsert:
+			tree.Insert(makeElem(data))
+		case journalDelete:
+			tree.Delete(makeElem(data))
+		case journalMode:
+			if len(data) != 1 || data[0] > 3 || tree.length > 0 && data[0] != tree.modeFlags() {
+				return nil, errors.New("Replay() got an invalid mode record")
+			}
+			tree.setModeFlags(data[0])
+		default:
+			return nil, fmt.Errorf("unknown journal record type %q", op)
 		}
-		fmt.Printf("--%.0f\n", c.maxChild)
-		tree.pprint(c.child, indentation+1)
 	}
 }
 
-// PrettyPrint pretty prints the tree so it can be visually validated or understood.
-// Runs in O(n log(n))
-func (tree *Tree23) PrettyPrint() {
-	//fmt.Printf("--%d(%.0f)\n", tree.root, tree.max(tree.root))
-	tree.pprint(tree.root, 0)
-	fmt.Printf("\n")
+// txnOp is one staged operation of a transaction.
+type txnOp struct {
+	op   byte
+	elem TreeElement
+}
+
+// Txn stages inserts and deletes for a tree, that are applied together with Commit or discarded with Rollback.
+// Staged operations are not visible in the tree before Commit, not even to the transaction itself.
+// Commit applies them in order to the tree as it is at that time, so changes made to the tree after Begin
+// are kept. A Txn is not safe for concurrent use, like the tree itself.
+type Txn struct {
+	tree *Tree23
+	ops  []txnOp
+}
+
+// Begin starts a new transaction for the tree.
+// Runs in O(1)
+func (tree *Tree23) Begin() *Txn {
+	return &Txn{tree: tree}
+}
+
+// Insert stages the insert of elem.
+// Runs in O(1)
+func (txn *Txn) Insert(elem TreeElement) {
+	txn.ops = append(txn.ops, txnOp{journalInsert, elem})
+}
+
+// Delete stages the delete of elem.
+// Runs in O(1)
+func (txn *Txn) Delete(elem TreeElement) {
+	txn.ops = append(txn.ops, txnOp{journalDelete, elem})
+}
+
+// Commit applies all staged operations in order to the tree with Insert and Delete.
+// Afterwards the transaction is empty and can be used again.
+// Runs in O(k log(n)) for k staged operations
+func (txn *Txn) Commit() {
+	// Panic before anything is applied, if the tree is frozen.
+	txn.tree.beginMutation()
+	for _, o := range txn.ops {
+		switch o.op {
+		case journalInsert:
+			txn.tree.Insert(o.elem)
+		case journalDelete:
+			txn.tree.Delete(o.elem)
+		}
+	}
+	txn.ops = txn.ops[:0]
+}
+
+// Rollback discards all staged operations. The tree is not changed.
+// Afterwards the transaction is empty and can be used again.
+// Runs in O(1)
+func (txn *Txn) Rollback() {
+	txn.ops = txn.ops[:0]
+}
+
+// findEqual returns the first leaf equal to elem or -1, if there is none.
+// All leaves with the same value as elem are searched.
+func (tree *Tree23) findEqual(elem TreeElement) TreeNodeIndex {
+	return tree.findEqualKey(elem, tree.key(elem))
+}
+
+// findEqualKey works like findEqual, but uses the given key instead of the key of elem.
+func (tree *Tree23) findEqualKey(elem TreeElement, k float64) TreeNodeIndex {
+	if tree.IsEmpty(tree.root) {
+		return -1
+	}
+
+	l, err := tree.findFirstLargerLeafRec(tree.root, k)
+	if err != nil {
+		return -1
+	}
+	for i := 0; i < tree.length && tree.leafKey(l) == k; i++ {
+		if elem.Equal(tree.treeNodes[l].elem) {
+			return l
+		}
+		// All following leaves are larger than elem.
+		if tree.tieBreaker != nil && tree.tieBreaker(elem, tree.treeNodes[l].elem) {
+			return -1
+		}
+		l = tree.treeNodes[l].next
+	}
+	return -1
+}
+
+// Find tries to find the leaf node with the given element in t.
+// If found, it will return the leaf node. Otherwise generated an error accordingly.
+// If there are multiple equal elements, the first one is returned.
+// Runs in O(log(n)) plus the number of elements with the same value as elem
+func (tree *Tree23) Find(elem TreeElement) (TreeNodeIndex, error) {
+	if tree.IsEmpty(tree.root) {
+		if tree.metrics != nil {
+			tree.metrics.ObserveFind(0, false)
+		}
+		return -1, errors.New("Tree is empty. No elements can be found.")
+	}
+	l := tree.findEqual(elem)
+	if tree.metrics != nil {
+		tree.metrics.ObserveFind(tree.height(tree.root), l != -1)
+	}
+	if l == -1 {
+		return -1, errors.New("TreeElement can not be found in the tree.")
+	}
+	return l, nil
+}
+
+// CountEqual returns the number of elements equal to elem.
+// Equal elements are always next to each other in the leaf list. Elements with the same value, that are
+// not equal to elem, are not counted.
+// Runs in O(log(n) + k) for k elements with the same value as elem
+func (tree *Tree23) CountEqual(elem TreeElement) int {
+	l := tree.findEqual(elem)
+	count := 0
+	for l != -1 && count < tree.length && elem.Equal(tree.treeNodes[l].elem) {
+		count++
+		l = tree.treeNodes[l].next
+	}
+	return count
+}
+
+// CountDistinct returns the number of different values of all elements in the tree.
+// Elements with the same value are next to each other, so the leaf list is walked once.
+// Runs in O(n)
+func (tree *Tree23) CountDistinct() int {
+	if tree.IsEmpty(tree.root) {
+		return 0
+	}
+	count := 1
+	for l := tree.treeNodes[tree.minLeaf].next; l != tree.minLeaf; l = tree.treeNodes[l].next {
+		if tree.leafKey(l) != tree.leafKey(tree.treeNodes[l].prev) {
+			count++
+		}
+	}
+	return count
+}
+
+// MaxGap returns the largest difference between the values of two neighboring elements,
+// together with the smaller (lower) and larger (upper) of both values.
+// If multiple gaps have the same width, the one between the smallest values is returned.
+// An error is returned, if the tree has less than two elements.
+// Runs in O(n)
+func (tree *Tree23) MaxGap() (lower, upper float64, gap float64, err error) {
+	if tree.length < 2 {
+		return 0, 0, 0, errors.New("MaxGap() needs at least two elements in the tree")
+	}
+
+	gap = -1
+	for l := tree.minLeaf; tree.treeNodes[l].next != tree.minLeaf; l = tree.treeNodes[l].next {
+		a, b := tree.leafKey(l), tree.leafKey(tree.treeNodes[l].next)
+		// Keys are negated for a descending tree, so the smaller value is on the right.
+		if tree.descending && b-a >= gap || !tree.descending && b-a > gap {
+			lower, upper, gap = a, b, b-a
+		}
+	}
+	lower, upper = tree.keyOf(lower), tree.keyOf(upper)
+	if tree.descending {
+		lower, upper = upper, lower
+	}
+	return lower, upper, gap, nil
+}
+
+// FindInterpolated works like Find, but estimates the position of elem from its value in relation
+// to the smallest and largest value. This assumes roughly uniformly distributed values.
+// As the tree does not save the sizes of its subtrees, the leaves are collected in sorted order once
+// enough lookups happened since the last modification to pay for it. Until then and for a frozen tree
+// without the sorted leaves, Find is used. From the estimated leaf, the leaf list is walked for at most
+// about log(n) steps, otherwise it falls back to Find as well (skewed distribution).
+// Runs in O(log(n)) amortized, O(1) for uniformly distributed values
+func (tree *Tree23) FindInterpolated(elem TreeElement) (TreeNodeIndex, error) {
+	if tree.IsEmpty(tree.root) {
+		return -1, errors.New("Tree is empty. No elements can be found.")
+	}
+
+	minValue, _ := tree.MinValue()
+	maxValue, _ := tree.MaxValue()
+	minKey := tree.keyOf(minValue)
+	maxKey := tree.keyOf(maxValue)
+	v := tree.key(elem)
+
+	if v < minKey || v > maxKey {
+		return -1, errors.New("TreeElement can not be found in the tree.")
+	}
+	if minKey == maxKey || math.IsInf(minKey, 0) || math.IsInf(maxKey, 0) {
+		return tree.Find(elem)
+	}
+
+	// We accept about as many steps as a descent from the root would take.
+	maxSteps := bits.Len(uint(tree.length))
+
+	// A frozen tree might be read by other goroutines, so it is never changed here.
+	if tree.leafOrder == nil {
+		if tree.frozen {
+			return tree.Find(elem)
+		}
+		tree.leafOrderMisses++
+		if tree.leafOrderMisses*maxSteps < tree.length {
+			return tree.Find(elem)
+		}
+		tree.leafOrder = tree.LeafIndices()
+	}
+
+	pos := int((v - minKey) / (maxKey - minKey) * float64(tree.length-1))
+	smallest := tree.leafOrder[0]
+	largest := tree.leafOrder[tree.length-1]
+	l := tree.leafOrder[pos]
+	steps := 0
+
+	// Walk to the first leaf with a value not smaller than v.
+	for tree.leafKey(l) < v {
+		if l == largest || steps == maxSteps {
+			return tree.Find(elem)
+		}
+		l = tree.treeNodes[l].next
+		steps++
+	}
+	for l != smallest && tree.leafKey(tree.treeNodes[l].prev) >= v {
+		if steps == maxSteps {
+			return tree.Find(elem)
+		}
+		l = tree.treeNodes[l].prev
+		steps++
+	}
+
+	for tree.leafKey(l) == v {
+		if elem.Equal(tree.treeNodes[l].elem) {
+			return l, nil
+		}
+		if l == largest {
+			break
+		}
+		l = tree.treeNodes[l].next
+	}
+	return -1, errors.New("TreeElement can not be found in the tree.")
+}
+
+// FindBatch finds the leaf nodes of all given elements and returns them in the same order.
+// For elements that can not be found, -1 is returned at their position.
+// For small batches, every element is searched with Find in O(k log(n)).
+// For large batches (k log(n) > n), the elements are sorted and all leaves are walked once in O(k log(k) + n).
+func (tree *Tree23) FindBatch(elems []TreeElement) []TreeNodeIndex {
+
+	result := make([]TreeNodeIndex, len(elems))
+
+	if len(elems)*bits.Len(uint(tree.length)) <= tree.length {
+		for i, e := range elems {
+			l, err := tree.Find(e)
+			if err != nil {
+				l = -1
+			}
+			result[i] = l
+		}
+		return result
+	}
+
+	keys := make([]float64, len(elems))
+	order := make([]int, len(elems))
+	for i, e := range elems {
+		keys[i] = tree.key(e)
+		order[i] = i
+		result[i] = -1
+	}
+	sort.Slice(order, func(i, j int) bool { return keys[order[i]] < keys[order[j]] })
+
+	if tree.IsEmpty(tree.root) {
+		return result
+	}
+
+	l, _ := tree.GetSmallestLeaf()
+	pos := 0
+	for _, i := range order {
+		// Move to the first leaf not smaller than the element.
+		for pos < tree.length && tree.leafKey(l) < keys[i] {
+			l = tree.treeNodes[l].next
+			pos++
+		}
+		// Search all leaves with the same value.
+		for run, p := l, pos; p < tree.length && tree.leafKey(run) == keys[i]; run, p = tree.treeNodes[run].next, p+1 {
+			if elems[i].Equal(tree.treeNodes[run].elem) {
+				result[i] = run
+				break
+			}
+		}
+	}
+	return result
+}
+
+// ContainsAll checks, if all given elements are in the tree.
+// Returns false and the first element, that can not be found. Otherwise true and nil are returned.
+// If elems is sorted and large (k log(n) > n), all leaves are walked once in O(k + n).
+// Otherwise every element is searched on its own in O(k log(n)).
+func (tree *Tree23) ContainsAll(elems []TreeElement) (bool, TreeElement) {
+
+	sorted := len(elems)*bits.Len(uint(tree.length)) > tree.length
+	for i := 1; sorted && i < len(elems); i++ {
+		sorted = tree.key(elems[i-1]) <= tree.key(elems[i])
+	}
+
+	if !sorted {
+		for _, e := range elems {
+			if tree.findEqual(e) == -1 {
+				return false, e
+			}
+		}
+		return true, nil
+	}
+
+	l, _ := tree.GetSmallestLeaf()
+	pos := 0
+	for _, e := range elems {
+		k := tree.key(e)
+		// Move to the first leaf not smaller than the element.
+		for pos < tree.length && tree.leafKey(l) < k {
+			l = tree.treeNodes[l].next
+			pos++
+		}
+		// Search all leaves with the same value.
+		found := false
+		for run, p := l, pos; !found && p < tree.length && tree.leafKey(run) == k; run, p = tree.treeNodes[run].next, p+1 {
+			found = e.Equal(tree.treeNodes[run].elem)
+		}
+		if !found {
+			return false, e
+		}
+	}
+	return true, nil
+}
+
+// findFirstLargerLeafRec is the recursive function for finding the smallest node bigger than value v in t.
+func (tree *Tree23) findFirstLargerLeafRec(t TreeNodeIndex, v float64) (TreeNodeIndex, error) {
+	if tree.IsLeaf(t) {
+		if v <= tree.leafKey(t) {
+			return t, nil
+		}
+		return -1, errors.New("TreeElement can not be found in the tree.")
+	}
+
+	subTree := tree.deleteFrom(t, v)
+	if subTree == -1 {
+		return -1, errors.New("TreeElement can not be found in the tree.")
+	}
+
+	return tree.findFirstLargerLeafRec(tree.treeNodes[t].children[subTree].child, v)
+}
+
+// FindFirstLargerLeaf returns the smallest leaf with a value bigger or equal than v (>= v)!
+// Use FindFirstStrictlyLargerLeaf to skip leaves with a value of exactly v.
+// If there is no such element, an error is returned ()
+// Runs in O(log(n))
+func (tree *Tree23) FindFirstLargerLeaf(v float64) (TreeNodeIndex, error) {
+	if tree.IsEmpty(tree.root) {
+		return -1, errors.New("Tree is empty. No elements can be found.")
+	}
+
+	return tree.findFirstLargerLeafRec(tree.root, tree.keyOf(v))
+}
+
+// findFirstStrictlyLargerLeafRec is the recursive function for finding the smallest node strictly bigger than value v in t.
+func (tree *Tree23) findFirstStrictlyLargerLeafRec(t TreeNodeIndex, v float64) (TreeNodeIndex, error) {
+	if tree.IsLeaf(t) {
+		if v < tree.leafKey(t) {
+			return t, nil
+		}
+		return -1, errors.New("TreeElement can not be found in the tree.")
+	}
+
+	for i := 0; i < tree.treeNodes[t].cCount; i++ {
+		if v < tree.treeNodes[t].children[i].maxChild {
+			return tree.findFirstStrictlyLargerLeafRec(tree.treeNodes[t].children[i].child, v)
+		}
+	}
+	return -1, errors.New("TreeElement can not be found in the tree.")
+}
+
+// FindFirstStrictlyLargerLeaf returns the smallest leaf with a value strictly bigger than v (> v)!
+// In contrast to FindFirstLargerLeaf, all leaves with a value of exactly v are skipped.
+// If there is no such element, an error is returned.
+// Runs in O(log(n))
+func (tree *Tree23) FindFirstStrictlyLargerLeaf(v float64) (TreeNodeIndex, error) {
+	if tree.IsEmpty(tree.root) {
+		return -1, errors.New("Tree is empty. No elements can be found.")
+	}
+
+	return tree.findFirstStrictlyLargerLeafRec(tree.root, tree.keyOf(v))
+}
+
+// lastBefore returns the leaf before first, or the largest leaf if first could not be found (err != nil).
+// If the leaf before first does not satisfy ok (we wrapped around), an error is returned.
+func (tree *Tree23) lastBefore(first TreeNodeIndex, err error, ok func(TreeNodeIndex) bool) (TreeNodeIndex, error) {
+	if err != nil {
+		return tree.GetLargestLeaf()
+	}
+	l := tree.treeNodes[first].prev
+	if !ok(l) {
+		return -1, errors.New("TreeElement can not be found in the tree.")
+	}
+	return l, nil
+}
+
+// FindLastSmallerOrEqualLeaf returns the largest leaf with a value smaller or equal than v (<= v)!
+// For multiple leaves with a value of v, the last of them is returned.
+// If there is no such element, an error is returned.
+// Runs in O(log(n))
+func (tree *Tree23) FindLastSmallerOrEqualLeaf(v float64) (TreeNodeIndex, error) {
+	if tree.IsEmpty(tree.root) {
+		return -1, errors.New("Tree is empty. No elements can be found.")
+	}
+
+	k := tree.keyOf(v)
+	first, err := tree.findFirstStrictlyLargerLeafRec(tree.root, k)
+	return tree.lastBefore(first, err, func(l TreeNodeIndex) bool { return tree.leafKey(l) <= k })
+}
+
+// RangeBounds returns the first and the last leaf with a value within [low, high].
+// All leaves of the range can then be visited by following Next from start up to and including end.
+// For a tree from NewDescending, start is the leaf with the largest value within the range.
+// An error is returned, if there is no leaf in the range.
+// Runs in O(log(n))
+func (tree *Tree23) RangeBounds(low, high float64) (start, end TreeNodeIndex, err error) {
+	if tree.IsEmpty(tree.root) {
+		return -1, -1, errors.New("Tree is empty. No elements can be found.")
+	}
+
+	lowKey, highKey := tree.keyOf(low), tree.keyOf(high)
+	if tree.descending {
+		lowKey, highKey = highKey, lowKey
+	}
+
+	start, err = tree.findFirstLargerLeafRec(tree.root, lowKey)
+	if err != nil || tree.leafKey(start) > highKey {
+		return -1, -1, errors.New("There are no elements within the range in the tree.")
+	}
+	first, err := tree.findFirstStrictlyLargerLeafRec(tree.root, highKey)
+	end, err = tree.lastBefore(first, err, func(TreeNodeIndex) bool { return true })
+	return start, end, err
+}
+
+// FindLastSmallerLeaf returns the largest leaf with a value strictly smaller than v (< v)!
+// If there is no such element, an error is returned.
+// Runs in O(log(n))
+func (tree *Tree23) FindLastSmallerLeaf(v float64) (TreeNodeIndex, error) {
+	if tree.IsEmpty(tree.root) {
+		return -1, errors.New("Tree is empty. No elements can be found.")
+	}
+
+	k := tree.keyOf(v)
+	first, err := tree.findFirstLargerLeafRec(tree.root, k)
+	return tree.lastBefore(first, err, func(l TreeNodeIndex) bool { return tree.leafKey(l) < k })
+}
+
+// closest returns the leaf with the key closest to k. For equal distances, the leaf with the smaller value
+// is returned, also for a tree from NewDescending. The tree must not be empty.
+func (tree *Tree23) closest(k float64) TreeNodeIndex {
+	above, err := tree.findFirstLargerLeafRec(tree.root, k)
+	if err != nil {
+		l, _ := tree.GetLargestLeaf()
+		return l
+	}
+	if tree.leafKey(above) == k {
+		return above
+	}
+	// The predecessor is only smaller, if we did not wrap around.
+	below := tree.treeNodes[above].prev
+	if tree.leafKey(below) >= k {
+		return above
+	}
+	// below has the larger value in a descending tree.
+	dBelow, dAbove := k-tree.leafKey(below), tree.leafKey(above)-k
+	if dBelow < dAbove || dBelow == dAbove && !tree.descending {
+		return below
+	}
+	return above
+}
+
+// FindApprox returns the leaf with the value closest to v, if its value is within epsilon of v.
+// For two leaves with the same distance, the one with the smaller value is returned.
+// If there is no leaf within epsilon, an error is returned.
+// Runs in O(log(n))
+func (tree *Tree23) FindApprox(v float64, epsilon float64) (TreeNodeIndex, error) {
+	if tree.IsEmpty(tree.root) {
+		return -1, errors.New("Tree is empty. No elements can be found.")
+	}
+
+	k := tree.keyOf(v)
+	l := tree.closest(k)
+	if math.Abs(tree.leafKey(l)-k) > epsilon {
+		return -1, errors.New("TreeElement can not be found in the tree.")
+	}
+	return l, nil
+}
+
+// ClosestToMean returns the leaf with the value closest to the arithmetic mean of all values.
+// For two leaves with the same distance, the one with the smaller value is returned.
+// An error is returned for an empty tree or if the mean is undefined, because the values contain +Inf and -Inf.
+// Runs in O(n)
+func (tree *Tree23) ClosestToMean() (TreeNodeIndex, error) {
+	if tree.IsEmpty(tree.root) {
+		return -1, errors.New("Tree is empty. No elements can be found.")
+	}
+
+	sum := 0.0
+	for v := range tree.Keys() {
+		sum += v
+	}
+	mean := sum / float64(tree.length)
+	if math.IsNaN(mean) {
+		return -1, errors.New("The mean of the values in the tree is undefined.")
+	}
+	return tree.closest(tree.keyOf(mean)), nil
+}
+
+// PercentileRank returns the fraction of elements with a value smaller than v, which is in [0, 1].
+// A value below all elements results in 0, a value above all elements in 1.
+// NaN is returned for an empty tree.
+// The tree does not know the sizes of its subtrees, so the leaf list is walked up to v.
+// Runs in O(n)
+func (tree *Tree23) PercentileRank(v float64) float64 {
+	if tree.IsEmpty(tree.root) {
+		return math.NaN()
+	}
+	count := 0
+	for x := range tree.Keys() {
+		if x < v {
+			count++
+		} else if !tree.descending {
+			break
+		}
+	}
+	return float64(count) / float64(tree.length)
+}
+
+// Nearest returns the leaf closest to v on the side given by dir. For dir < 0, this is the leaf with the largest
+// value smaller or equal than v (floor). For dir > 0, the leaf with the smallest value larger or equal than v (ceiling).
+// For dir == 0, the leaf with the closest value on either side. For two leaves with the same distance,
+// the one with the smaller value is returned, like with FindApprox.
+// Multiple leaves with the same value are resolved like with FindLastSmallerOrEqualLeaf and FindFirstLargerLeaf.
+// The sides refer to the values, also for a tree from NewDescending.
+// An error is returned, if there is no leaf on the requested side.
+// Runs in O(log(n))
+func (tree *Tree23) Nearest(v float64, dir int) (TreeNodeIndex, error) {
+	if tree.IsEmpty(tree.root) {
+		return -1, errors.New("Tree is empty. No elements can be found.")
+	}
+
+	floor, ceiling := tree.FindLastSmallerOrEqualLeaf, tree.FindFirstLargerLeaf
+	if tree.descending {
+		floor, ceiling = ceiling, floor
+	}
+	switch {
+	case dir < 0:
+		return floor(v)
+	case dir > 0:
+		return ceiling(v)
+	}
+	return tree.closest(tree.keyOf(v)), nil
+}
+
+// FindAllApprox returns all leaves with a value within [v-epsilon, v+epsilon] in sorted order.
+// With an epsilon of 0, all leaves with exactly the value v are returned.
+// If there are no such leaves, an empty slice is returned.
+// Runs in O(log(n) + k) for k returned leaves
+func (tree *Tree23) FindAllApprox(v, epsilon float64) []TreeNodeIndex {
+	leaves := make([]TreeNodeIndex, 0)
+	tree.walkRange(v-epsilon, v+epsilon, func(l TreeNodeIndex) bool {
+		leaves = append(leaves, l)
+		return true
+	})
+	return leaves
+}
+
+// Bracket returns the largest leaf with a value smaller or equal than v (below) and the smallest leaf
+// with a value bigger or equal than v (above) with only one descent through the tree.
+// If there is no such leaf on one side, -1 is returned for that side.
+// If v matches an element exactly, below and above both are the first leaf with a value of v.
+// An error is returned for an empty tree.
+// Runs in O(log(n))
+func (tree *Tree23) Bracket(v float64) (below, above TreeNodeIndex, err error) {
+	if tree.IsEmpty(tree.root) {
+		return -1, -1, errors.New("Tree is empty. No elements can be found.")
+	}
+
+	v = tree.keyOf(v)
+	above, err = tree.findFirstLargerLeafRec(tree.root, v)
+	if err != nil {
+		// Every element is smaller than v.
+		below, _ = tree.GetLargestLeaf()
+		return below, -1, nil
+	}
+
+	if tree.leafKey(above) == v {
+		return above, above, nil
+	}
+
+	// above is the first leaf not smaller than v. So its predecessor is either smaller than v
+	// or we wrapped around to the largest leaf and there is nothing below v.
+	below = tree.treeNodes[above].prev
+	if tree.leafKey(below) >= v {
+		below = -1
+	}
+	return below, above, nil
+}
+
+// Previous returns the previous leaf node that is smaller or equal than itself.
+// For the smallest/first node in the tree, Previous will return the biggest/last node!
+// Previous only works for leaf nodes and will generate an error otherwise.
+// Runs in O(1)
+func (tree *Tree23) Previous(t TreeNodeIndex) (TreeNodeIndex, error) {
+	if tree.IsEmpty(t) {
+		return -1, errors.New("Previous() does not work for empty trees")
+	}
+	if tree.IsLeaf(t) {
+		return tree.treeNodes[t].prev, nil
+	}
+	return -1, errors.New("Previous() only works for leaf nodes!")
+}
+
+// Next returns the next leaf node that is bigger or equal than itself.
+// For the biggest/last node in the tree, Next will return the smallest/first node!
+// Next only works for leaf nodes and will generated an error otherwise.
+// Runs in O(1)
+func (tree *Tree23) Next(t TreeNodeIndex) (TreeNodeIndex, error) {
+	if tree.IsEmpty(t) {
+		return -1, errors.New("Next() does not work for empty trees")
+	}
+	if tree.IsLeaf(t) {
+		return tree.treeNodes[t].next, nil
+	}
+	return -1, errors.New("Next() only works for leaf nodes!")
+}
+
+// Neighbors returns the previous and next leaf of t. Other than Previous and Next, this does not wrap around:
+// prevOK is false for the smallest leaf and nextOK is false for the largest leaf. The missing neighbor is -1 then.
+// Both are false, if t is not a leaf of the tree.
+// Runs in O(1)
+func (tree *Tree23) Neighbors(t TreeNodeIndex) (prev TreeNodeIndex, prevOK bool, next TreeNodeIndex, nextOK bool) {
+	prev, next = -1, -1
+	if !tree.isLeafNode(t) {
+		return
+	}
+	if t != tree.minLeaf {
+		prev, prevOK = tree.treeNodes[t].prev, true
+	}
+	if n := tree.treeNodes[t].next; n != tree.minLeaf {
+		next, nextOK = n, true
+	}
+	return
+}
+
+// AreAdjacent returns true, if a and b are leaves of the tree that directly follow each other in sorted order,
+// in any direction. The link from the largest back to the smallest leaf does not count, so the largest and
+// smallest leaf are not adjacent (unless the tree has only these two leaves). A leaf is not adjacent to itself.
+// Returns false, if a or b is not a leaf of the tree.
+// Runs in O(1)
+func (tree *Tree23) AreAdjacent(a, b TreeNodeIndex) bool {
+	if a == b || !tree.isLeafNode(a) || !tree.isLeafNode(b) {
+		return false
+	}
+	return tree.treeNodes[a].next == b && b != tree.minLeaf || tree.treeNodes[b].next == a && a != tree.minLeaf
+}
+
+// NextValue returns the element following elem in the tree. Other than Next, this does not wrap around:
+// If elem is the largest element or not in the tree, nil and false are returned.
+// Elements equal to elem are skipped, so the result is never equal to elem.
+// Runs in O(log(n) + k) for k elements equal to elem
+func (tree *Tree23) NextValue(elem TreeElement) (TreeElement, bool) {
+	l := tree.findEqual(elem)
+	if l == -1 {
+		return nil, false
+	}
+	for l = tree.treeNodes[l].next; l != tree.minLeaf; l = tree.treeNodes[l].next {
+		if !elem.Equal(tree.treeNodes[l].elem) {
+			return tree.treeNodes[l].elem, true
+		}
+	}
+	return nil, false
+}
+
+// PrevValue returns the element before elem in the tree. Other than Previous, this does not wrap around:
+// If elem is the smallest element or not in the tree, nil and false are returned.
+// Runs in O(log(n))
+func (tree *Tree23) PrevValue(elem TreeElement) (TreeElement, bool) {
+	l := tree.findEqual(elem)
+	if l == -1 || l == tree.minLeaf {
+		return nil, false
+	}
+	return tree.treeNodes[tree.treeNodes[l].prev].elem, true
+}
+
+// Cursor iterates over the leaves of a tree in sorted order and allows to delete the current leaf
+// without losing the position. Other modifications of the tree invalidate the cursor.
+type Cursor struct {
+	tree *Tree23
+	leaf TreeNodeIndex
+	// Number of leaves left, including the current one.
+	remaining int
+}
+
+// NewCursor returns a cursor positioned at the smallest leaf of the tree.
+// For an empty tree, the cursor is not valid.
+// Runs in O(1)
+func (tree *Tree23) NewCursor() *Cursor {
+	l, _ := tree.GetSmallestLeaf()
+	return &Cursor{tree, l, tree.length}
+}
+
+// Valid returns true, if the cursor points to a leaf. It is false after the largest leaf.
+func (c *Cursor) Valid() bool {
+	return c.remaining > 0
+}
+
+// Leaf returns the current leaf or -1, if the cursor is not valid.
+func (c *Cursor) Leaf() TreeNodeIndex {
+	if !c.Valid() {
+		return -1
+	}
+	return c.leaf
+}
+
+// Value returns the element of the current leaf or nil, if the cursor is not valid.
+func (c *Cursor) Value() TreeElement {
+	if !c.Valid() {
+		return nil
+	}
+	return c.tree.treeNodes[c.leaf].elem
+}
+
+// Next moves the cursor to the next leaf. It does not wrap around after the largest leaf.
+// Runs in O(1)
+func (c *Cursor) Next() {
+	if !c.Valid() {
+		return
+	}
+	c.leaf = c.tree.treeNodes[c.leaf].next
+	c.remaining--
+}
+
+// Remove deletes the current leaf from the tree and moves the cursor to the next leaf.
+// An error is returned, if the cursor is not valid.
+// Runs in O(log(n))
+func (c *Cursor) Remove() error {
+	if !c.Valid() {
+		return errors.New("Remove() needs a valid cursor")
+	}
+	// The successor has to be known before the leaf is unlinked.
+	next := c.tree.treeNodes[c.leaf].next
+	if err := c.tree.DeleteNode(c.leaf); err != nil {
+		return err
+	}
+	c.leaf = next
+	c.remaining--
+	return nil
+}
+
+// RangeIterator lazily iterates over all elements with a value within a range in sorted order.
+// It does not hold any resources, so it can be abandoned at any time.
+// Modifications of the tree invalidate the iterator.
+type RangeIterator struct {
+	tree *Tree23
+	// Current leaf or -1 before the first and after the last element.
+	leaf TreeNodeIndex
+	// Next leaf to check or -1, if the iteration is done.
+	next    TreeNodeIndex
+	highKey float64
+}
+
+// FindRange returns an iterator over all elements with a value within [low, high].
+// The iterator is positioned before the first element, so Next has to be called before Value.
+// An empty range results in an iterator, whose first Next returns false.
+// Runs in O(log(n))
+func (tree *Tree23) FindRange(low, high float64) *RangeIterator {
+	it := &RangeIterator{tree, -1, -1, 0}
+	if tree.IsEmpty(tree.root) {
+		return it
+	}
+	lowKey, highKey := tree.keyOf(low), tree.keyOf(high)
+	if tree.descending {
+		lowKey, highKey = highKey, lowKey
+	}
+	if l, err := tree.findFirstLargerLeafRec(tree.root, lowKey); err == nil {
+		it.next = l
+		it.highKey = highKey
+	}
+	return it
+}
+
+// Next moves the iterator to the next element within the range and returns true, if there is one.
+// It does not wrap around after the largest leaf.
+// Runs in O(1)
+func (it *RangeIterator) Next() bool {
+	if it.next == -1 || it.tree.leafKey(it.next) > it.highKey {
+		it.leaf, it.next = -1, -1
+		return false
+	}
+	it.leaf = it.next
+	it.next = it.tree.treeNodes[it.leaf].next
+	if it.next == it.tree.minLeaf {
+		it.next = -1
+	}
+	return true
+}
+
+// Value returns the current element or nil, if Next was not called yet or returned false.
+func (it *RangeIterator) Value() TreeElement {
+	if it.leaf == -1 {
+		return nil
+	}
+	return it.tree.treeNodes[it.leaf].elem
+}
+
+// PriorityQueue uses the tree as a priority queue, that returns the element with the smallest value first.
+// Based on a tree from NewDescending, the element with the largest value is returned first.
+// All functions of the tree can be used as well.
+type PriorityQueue struct {
+	*Tree23
+}
+
+// NewPriorityQueue creates a new empty priority queue.
+// Runs in O(1)
+func NewPriorityQueue() PriorityQueue {
+	return PriorityQueue{New()}
+}
+
+// Push adds elem to the queue.
+// Runs in O(log(n))
+func (pq PriorityQueue) Push(elem TreeElement) {
+	pq.Insert(elem)
+}
+
+// Peek returns the element with the smallest value without removing it.
+// If the queue is empty, false is returned.
+// Runs in O(1)
+func (pq PriorityQueue) Peek() (TreeElement, bool) {
+	l, err := pq.GetSmallestLeaf()
+	if err != nil {
+		return nil, false
+	}
+	return pq.treeNodes[l].elem, true
+}
+
+// Pop removes and returns the element with the smallest value.
+// The order of elements with the same value is not specified.
+// If the queue is empty, false is returned.
+// Runs in O(log(n))
+func (pq PriorityQueue) Pop() (TreeElement, bool) {
+	l, err := pq.GetSmallestLeaf()
+	if err != nil {
+		return nil, false
+	}
+	elem := pq.treeNodes[l].elem
+	pq.DeleteNode(l)
+	return elem, true
+}
+
+// minmaxDepth returns the minimum and maximum depth of all children (recursively) of t.
+func (tree *Tree23) minmaxDepth(t TreeNodeIndex) (int, int) {
+	if tree.IsEmpty(t) {
+		return 0, 0
+	}
+	if tree.IsLeaf(t) {
+		return 1, 1
+	}
+	depthMin := -1
+	depthMax := -1
+
+	for i := 0; i < tree.treeNodes[t].cCount; i++ {
+		c := tree.treeNodes[t].children[i]
+		min, max := tree.minmaxDepth(c.child)
+		if depthMin == -1 || min < depthMin {
+			depthMin = min + 1
+		}
+		if depthMax == -1 || max > depthMax {
+			depthMax = max + 1
+		}
+	}
+	return depthMin, depthMax
+}
+
+// IsBalanced returns true, if the left-most and the right-most leaf are on the same level.
+// This is a cheap sanity check and does not look at the inner subtrees. Invariant checks all leaves.
+// An empty tree is balanced.
+// Runs in O(log(n))
+func (tree *Tree23) IsBalanced() bool {
+	if tree.IsEmpty(tree.root) {
+		return true
+	}
+	right := 0
+	for t := tree.root; !tree.IsLeaf(t); right++ {
+		t = tree.treeNodes[t].children[tree.treeNodes[t].cCount-1].child
+	}
+	return tree.height(tree.root) == right
+}
+
+// Depths returns the minimum and maximum depth of the tree t.
+// minimum and maximum should always be the same ()
+// Runs in O(log(n))
+func (tree *Tree23) Depths() (int, int) {
+	return tree.minmaxDepth(tree.root)
+}
+
+// getSmallestLeafRec is the recursive function that returns the left-most leaf node.
+func (tree *Tree23) getSmallestLeafRec(t TreeNodeIndex) (TreeNodeIndex, error) {
+	if tree.IsLeaf(t) {
+		return t, nil
+	}
+	return tree.getSmallestLeafRec(tree.treeNodes[t].children[0].child)
+}
+
+// GetSmallestLeaf returns the leaf node of the smallest element in t
+// or sets an error if the tree is empty.
+// The smallest leaf is cached in the tree.
+// Runs in O(1)
+func (tree *Tree23) GetSmallestLeaf() (TreeNodeIndex, error) {
+	if tree.IsEmpty(tree.root) {
+		return -1, errors.New("No leaf for an empty tree")
+	}
+	return tree.minLeaf, nil
+}
+
+// GetLargestLeaf returns the leaf node of the largest element in t
+// or sets an error if the tree is empty.
+// Runs in O(1)
+func (tree *Tree23) GetLargestLeaf() (TreeNodeIndex, error) {
+	l, err := tree.GetSmallestLeaf()
+	if err != nil {
+		return -1, err
+	}
+
+	return tree.Previous(l)
+}
+
+// DeleteMin removes the smallest element from the tree.
+// Returns false, if the tree is empty.
+// Runs in O(log(n))
+func (tree *Tree23) DeleteMin() bool {
+	tree.beginMutation()
+	if tree.IsEmpty(tree.root) {
+		return false
+	}
+	return tree.DeleteNode(tree.minLeaf) == nil
+}
+
+// DeleteMax removes the largest element from the tree.
+// Returns false, if the tree is empty.
+// Runs in O(log(n))
+func (tree *Tree23) DeleteMax() bool {
+	tree.beginMutation()
+	if tree.IsEmpty(tree.root) {
+		return false
+	}
+	return tree.DeleteNode(tree.treeNodes[tree.minLeaf].prev) == nil
+}
+
+// MinValue returns the value of the smallest element in the tree
+// or sets an error if the tree is empty.
+// Runs in O(1)
+func (tree *Tree23) MinValue() (float64, error) {
+	l, err := tree.GetSmallestLeaf()
+	if err != nil {
+		return 0, err
+	}
+	return tree.treeNodes[l].elem.ExtractValue(), nil
+}
+
+// MaxValue returns the value of the largest element in the tree
+// or sets an error if the tree is empty.
+// Runs in O(1)
+func (tree *Tree23) MaxValue() (float64, error) {
+	l, err := tree.GetLargestLeaf()
+	if err != nil {
+		return 0, err
+	}
+	return tree.treeNodes[l].elem.ExtractValue(), nil
+}
+
+// FindAtFraction returns the leaf with the value closest to MinValue() + f*(MaxValue()-MinValue()).
+// Other than GetNthLeaf, the position is based on the values and not on the number of elements.
+// An error is returned for an empty tree or if f is not within [0, 1].
+// If the smallest or largest value is infinite, only the fractions 0 and 1 are defined.
+// Runs in O(log(n))
+func (tree *Tree23) FindAtFraction(f float64) (TreeNodeIndex, error) {
+	if !(f >= 0 && f <= 1) {
+		return -1, errors.New("FindAtFraction() needs a fraction within [0, 1]")
+	}
+	min, err := tree.MinValue()
+	if err != nil {
+		return -1, err
+	}
+	max, _ := tree.MaxValue()
+
+	switch {
+	case f == 0:
+		return tree.minLeaf, nil
+	case f == 1:
+		return tree.treeNodes[tree.minLeaf].prev, nil
+	}
+
+	v := min + f*(max-min)
+	if math.IsNaN(v) {
+		return -1, errors.New("FindAtFraction() is not defined for infinite values")
+	}
+	return tree.closest(tree.keyOf(v)), nil
+}
+
+// GetNthLeaf returns the leaf node at position n (starting with 0) in sorted order.
+// The tree does not save the sizes of its subtrees, so the leaf list is walked from the
+// smallest or largest leaf, whichever is closer.
+// Runs in O(min(n, Len()-n))
+func (tree *Tree23) GetNthLeaf(n int) (TreeNodeIndex, error) {
+	if n < 0 || n >= tree.length {
+		return -1, errors.New("GetNthLeaf() index out of range")
+	}
+
+	l, _ := tree.GetSmallestLeaf()
+	if n <= tree.length/2 {
+		for i := 0; i < n; i++ {
+			l = tree.treeNodes[l].next
+		}
+		return l, nil
+	}
+	for i := 0; i < tree.length-n; i++ {
+		l = tree.treeNodes[l].prev
+	}
+	return l, nil
+}
+
+// InterpolatedQuantile returns the q-quantile of all values with linear interpolation between the two closest
+// elements, like the default of numpy.percentile: For the position r = q*(Len()-1) in increasing order of the values,
+// the values at floor(r) and ceil(r) are interpolated. This is also the order for a tree from NewDescending.
+// An error is returned for an empty tree or if q is not within [0, 1].
+// Runs in O(min(r, Len()-r))
+func (tree *Tree23) InterpolatedQuantile(q float64) (float64, error) {
+	if tree.IsEmpty(tree.root) {
+		return 0, errors.New("Tree is empty. No elements can be found.")
+	}
+	if !(q >= 0 && q <= 1) {
+		return 0, errors.New("InterpolatedQuantile() needs a quantile within [0, 1]")
+	}
+
+	r := q * float64(tree.length-1)
+	lower := int(math.Floor(r))
+	if tree.descending {
+		lower = tree.length - 1 - int(math.Ceil(r))
+	}
+	l, _ := tree.GetNthLeaf(lower)
+	a := tree.treeNodes[l].elem.ExtractValue()
+	frac := r - math.Floor(r)
+	if frac == 0 {
+		return a, nil
+	}
+
+	b := tree.treeNodes[tree.treeNodes[l].next].elem.ExtractValue()
+	if tree.descending {
+		a, b = b, a
+	}
+	// Avoid NaN for equal infinite values.
+	if a == b {
+		return a, nil
+	}
+	return a + frac*(b-a), nil
+}
+
+// SelectRange returns the elements at the positions [startRank, endRank) in sorted order, starting with 0.
+// Both ranks are clamped to [0, Len()]. An empty, non-nil slice is returned, if endRank is not larger than startRank.
+// Runs in O(min(s, Len()-s) + k) for k returned elements starting at position s
+func (tree *Tree23) SelectRange(startRank, endRank int) []TreeElement {
+	startRank = min(max(startRank, 0), tree.length)
+	endRank = min(max(endRank, 0), tree.length)
+	if endRank <= startRank {
+		return []TreeElement{}
+	}
+
+	elems := make([]TreeElement, 0, endRank-startRank)
+	l, _ := tree.GetNthLeaf(startRank)
+	for i := startRank; i < endRank; i++ {
+		elems = append(elems, tree.treeNodes[l].elem)
+		l = tree.treeNodes[l].next
+	}
+	return elems
+}
+
+// ToSlice returns all elements in ascending order, walking from GetSmallestLeaf via Next.
+// An empty tree returns an empty, non-nil slice.
+// Runs in O(n)
+func (tree *Tree23) ToSlice() []TreeElement {
+	return tree.AppendValues(make([]TreeElement, 0, tree.length))
+}
+
+// Keys returns an iterator over the values of all elements in sorted order, to be used as
+// for v := range tree.Keys() {}. The values are cached in the leaves, so ExtractValue is not called.
+// The tree must not be modified during the iteration.
+// Runs in O(n)
+func (tree *Tree23) Keys() func(yield func(float64) bool) {
+	return func(yield func(float64) bool) {
+		if tree.IsEmpty(tree.root) {
+			return
+		}
+		smallest, _ := tree.GetSmallestLeaf()
+		for l := smallest; ; {
+			if !yield(tree.keyOf(tree.leafKey(l))) {
+				return
+			}
+			l = tree.treeNodes[l].next
+			if l == smallest {
+				return
+			}
+		}
+	}
+}
+
+// MergeWalk walks the sorted elements of a and b in lockstep and calls visit for every step.
+// If the next elements of both trees have the same value, visit gets both and cmp is 0 and both trees advance.
+// Otherwise visit gets only the smaller element, the other one is nil. cmp is -1, if it is from a and 1, if it is from b.
+// Both trees must be sorted in the same order, as given by NewDescending. Neither tree is modified.
+// Runs in O(n + m)
+func MergeWalk(a, b *Tree23, visit func(fromA, fromB TreeElement, cmp int)) {
+	la, _ := a.GetSmallestLeaf()
+	lb, _ := b.GetSmallestLeaf()
+	ia, ib := 0, 0
+
+	for ia < a.length || ib < b.length {
+		switch {
+		case ib == b.length || (ia < a.length && a.leafKey(la) < b.leafKey(lb)):
+			visit(a.treeNodes[la].elem, nil, -1)
+			la = a.treeNodes[la].next
+			ia++
+		case ia == a.length || b.leafKey(lb) < a.leafKey(la):
+			visit(nil, b.treeNodes[lb].elem, 1)
+			lb = b.treeNodes[lb].next
+			ib++
+		default:
+			visit(a.treeNodes[la].elem, b.treeNodes[lb].elem, 0)
+			la = a.treeNodes[la].next
+			lb = b.treeNodes[lb].next
+			ia++
+			ib++
+		}
+	}
+}
+
+// LeafIndices returns the indices of all leaf nodes in sorted order of their elements.
+// Together with AllocStats, this shows how the elements are scattered over the memory of the tree.
+// An empty tree returns an empty, non-nil slice.
+// Runs in O(n)
+func (tree *Tree23) LeafIndices() []TreeNodeIndex {
+	leaves := make([]TreeNodeIndex, 0, tree.length)
+	if tree.IsEmpty(tree.root) {
+		return leaves
+	}
+	smallest, _ := tree.GetSmallestLeaf()
+	for l := smallest; ; {
+		leaves = append(leaves, l)
+		l = tree.treeNodes[l].next
+		if l == smallest {
+			return leaves
+		}
+	}
+}
+
+// ForEachShuffled calls fn for all elements in a pseudo-random order until fn returns false.
+// The order only depends on seed and the elements of the tree, so the same seed always results in the same order.
+// The tree must not be modified by fn.
+// Runs in O(n)
+func (tree *Tree23) ForEachShuffled(seed int64, fn func(TreeElement) bool) {
+	leaves := tree.LeafIndices()
+	r := rand.New(rand.NewSource(seed))
+	r.Shuffle(len(leaves), func(i, j int) { leaves[i], leaves[j] = leaves[j], leaves[i] })
+	for _, l := range leaves {
+		if !fn(tree.treeNodes[l].elem) {
+			return
+		}
+	}
+}
+
+// ForEachStride calls fn for every k-th element in sorted order, starting with the smallest one,
+// until fn returns false. So fn gets the elements at the positions 0, k, 2k, ...
+// Nothing happens, if k is smaller than 1. The tree must not be modified by fn.
+// Runs in O(n)
+func (tree *Tree23) ForEachStride(k int, fn func(TreeElement) bool) {
+	if k < 1 || tree.IsEmpty(tree.root) {
+		return
+	}
+	for l, i := tree.minLeaf, 0; i < tree.length; i += k {
+		if !fn(tree.treeNodes[l].elem) {
+			return
+		}
+		for j := 0; j < k && i+j+1 < tree.length; j++ {
+			l = tree.treeNodes[l].next
+		}
+	}
+}
+
+// LeafScatter returns the fraction of neighbouring leaves (in sorted order), that are not stored
+// next to each other in ascending order in memory. 0 means, that all leaves are contiguous, which is
+// best for CPU caching when iterating. Deletes and inserts increase the scatter over time.
+// Runs in O(n)
+func (tree *Tree23) LeafScatter() float64 {
+	leaves := tree.LeafIndices()
+	if len(leaves) < 2 {
+		return 0
+	}
+	scattered := 0
+	for i := 1; i < len(leaves); i++ {
+		if leaves[i] != leaves[i-1]+1 {
+			scattered++
+		}
+	}
+	return float64(scattered) / float64(len(leaves)-1)
+}
+
+// Defragment rebuilds the tree into new memory, so that all leaves are stored contiguously and in
+// ascending order again. See LeafScatter for a measure of how scattered the leaves are.
+// All node indices change, so previously returned leaves must not be used afterwards.
+// Runs in O(n)
+func (tree *Tree23) Defragment() {
+
+	tree.beginMutation()
+
+	leaves := tree.LeafIndices()
+	elems := make([]TreeElement, len(leaves))
+	keys := make([]float64, len(leaves))
+	for i, l := range leaves {
+		elems[i] = tree.treeNodes[l].elem
+		keys[i] = tree.treeNodes[l].key
+	}
+
+	tree.treeNodes = make([]treeNode, len(tree.treeNodes))
+	tree.root = 0
+	tree.length = 0
+	tree.minLeaf = -1
+	tree.treeNodesFirstFreePos = 1
+	tree.treeNodesFreePositions = tree.treeNodesFreePositions[:0]
+
+	tree.buildSorted(elems, keys)
+}
+
+// AppendValues appends all elements in sorted order to buf and returns the extended buffer.
+// Reusing the buffer for repeated calls avoids allocations, as long as its capacity suffices.
+// Runs in O(n)
+func (tree *Tree23) AppendValues(buf []TreeElement) []TreeElement {
+	if tree.IsEmpty(tree.root) {
+		return buf
+	}
+	smallest, _ := tree.GetSmallestLeaf()
+	for l := smallest; ; {
+		buf = append(buf, tree.treeNodes[l].elem)
+		l = tree.treeNodes[l].next
+		if l == smallest {
+			return buf
+		}
+	}
+}
+
+// AppendValuesInRange appends all elements with a value within [low, high] in sorted order to buf
+// and returns the extended buffer.
+// Runs in O(log(n) + k) for k elements within [low, high]
+func (tree *Tree23) AppendValuesInRange(buf []TreeElement, low, high float64) []TreeElement {
+	tree.walkRange(low, high, func(l TreeNodeIndex) bool {
+		buf = append(buf, tree.treeNodes[l].elem)
+		return true
+	})
+	return buf
+}
+
+// EqualsSlice returns true, if the tree contains exactly the elements of expected in this order, compared with Equal.
+// Runs in O(n)
+func (tree *Tree23) EqualsSlice(expected []TreeElement) bool {
+	return len(expected) == tree.length && tree.DiffSlice(expected) == -1
+}
+
+// DiffSlice returns the first position, at which the elements of the tree in sorted order differ from expected.
+// If one is a prefix of the other, the length of the shorter one is returned. -1 is returned, if both are equal.
+// Runs in O(n)
+func (tree *Tree23) DiffSlice(expected []TreeElement) int {
+	l := tree.minLeaf
+	for i := 0; i < tree.length; i++ {
+		if i == len(expected) || !expected[i].Equal(tree.treeNodes[l].elem) {
+			return i
+		}
+		l = tree.treeNodes[l].next
+	}
+	if len(expected) > tree.length {
+		return tree.length
+	}
+	return -1
+}
+
+// ToSliceDescending returns all elements in descending order, walking from GetLargestLeaf via Previous.
+// An empty tree returns an empty, non-nil slice.
+// Runs in O(n)
+func (tree *Tree23) ToSliceDescending() []TreeElement {
+	elems := make([]TreeElement, 0, tree.length)
+	if tree.IsEmpty(tree.root) {
+		return elems
+	}
+	largest, _ := tree.GetLargestLeaf()
+	for l := largest; ; {
+		elems = append(elems, tree.treeNodes[l].elem)
+		l = tree.treeNodes[l].prev
+		if l == largest {
+			return elems
+		}
+	}
+}
+
+// Freeze2Array returns all elements sorted by increasing value, also for a tree from NewDescending.
+// The slice does not share any memory with the tree and can be searched with SearchArray,
+// so lookups of a tree, that is not modified anymore, can be served without the tree.
+// Runs in O(n)
+func (tree *Tree23) Freeze2Array() []TreeElement {
+	if tree.descending {
+		return tree.ToSliceDescending()
+	}
+	return tree.ToSlice()
+}
+
+// SearchArray returns the index of the first element in arr with a value larger or equal than v.
+// arr must be sorted by increasing value, like the result of Freeze2Array.
+// len(arr) is returned, if there is no such element.
+// Runs in O(log(n))
+func SearchArray(arr []TreeElement, v float64) int {
+	return sort.Search(len(arr), func(i int) bool {
+		return arr[i].ExtractValue() >= v
+	})
+}
+
+// checkLinkedList is the recursive function that runs through all leaf nodes by using
+// the provided prev/next pointers and checks them on validity until it reaches the start node again.
+func (tree *Tree23) checkLinkedList(startNode, currentNode TreeNodeIndex) bool {
+
+	nextNode := tree.treeNodes[currentNode].next
+	linkCheck := tree.treeNodes[nextNode].prev == currentNode
+
+	// Once all around.
+	if startNode == nextNode {
+		return linkCheck
+	}
+
+	increasing := tree.leafKey(nextNode) >= tree.leafKey(currentNode)
+
+	return linkCheck && increasing && tree.checkLinkedList(startNode, nextNode)
+}
+
+// leafListInvariant checks, that there are no dangling pointers and all elements are sorted increasingly!
+func (tree *Tree23) leafListInvariant() bool {
+
+	if tree.IsEmpty(tree.root) {
+		return true
+	}
+
+	// The cached smallest leaf must be the leftmost leaf of the tree.
+	startNode, _ := tree.getSmallestLeafRec(tree.root)
+	if startNode != tree.minLeaf {
+		return false
+	}
+	return tree.checkLinkedList(startNode, startNode)
+}
+
+// CheckLeafList checks, that the linked list of all leaf nodes has no dangling pointers,
+// links back from the last to the first leaf and that all elements are sorted increasingly.
+// Runs in O(n)
+func (tree *Tree23) CheckLeafList() bool {
+	return tree.leafListInvariant()
+}
+
+// relinkLeavesRec recursively sets the prev/next pointers of all leaves in t to their in-order neighbours.
+// last is the last leaf visited before t. Returns true, if any pointer had to be changed.
+func (tree *Tree23) relinkLeavesRec(t TreeNodeIndex, last *TreeNodeIndex) bool {
+
+	if tree.IsLeaf(t) {
+		changed := false
+		if *last != -1 {
+			if tree.treeNodes[*last].next != t {
+				tree.treeNodes[*last].next = t
+				changed = true
+			}
+			if tree.treeNodes[t].prev != *last {
+				tree.treeNodes[t].prev = *last
+				changed = true
+			}
+		}
+		*last = t
+		return changed
+	}
+
+	changed := false
+	for i := 0; i < tree.treeNodes[t].cCount; i++ {
+		changed = tree.relinkLeavesRec(tree.treeNodes[t].children[i].child, last) || changed
+	}
+	return changed
+}
+
+// relinkLeaves sets the prev/next pointers of all leaves according to the structure of the tree
+// and updates the cached smallest leaf. Returns true, if any pointer had to be changed.
+func (tree *Tree23) relinkLeaves() bool {
+
+	if tree.IsEmpty(tree.root) {
+		return false
+	}
+
+	last := TreeNodeIndex(-1)
+	changed := tree.relinkLeavesRec(tree.root, &last)
+
+	// Link the last leaf back to the first one.
+	first, _ := tree.getSmallestLeafRec(tree.root)
+	tree.minLeaf = first
+	if tree.treeNodes[last].next != first {
+		tree.treeNodes[last].next = first
+		changed = true
+	}
+	if tree.treeNodes[first].prev != last {
+		tree.treeNodes[first].prev = last
+		changed = true
+	}
+	return changed
+}
+
+// RepairLeafList rebuilds the linked list of all leaf nodes from the structure of the tree.
+// The order of the leaves in the tree is trusted, the values of the elements are not considered.
+// Returns true, if the list was broken and had to be repaired.
+// Runs in O(n)
+func (tree *Tree23) RepairLeafList() bool {
+	tree.beginMutation()
+	return tree.relinkLeaves()
+}
+
+// RelinkLeaves sets the prev/next pointers of all leaves by an in-order traversal of the tree,
+// including the link from the last leaf back to the first one.
+// This is done automatically by all functions that build the tree in bulk, like BuildFromSorted.
+// Runs in O(n)
+func (tree *Tree23) RelinkLeaves() {
+	tree.beginMutation()
+	tree.relinkLeaves()
+}
+
+// memoryCheckRec recursively runs through the whole tree and fills s with usage info.
+func (tree *Tree23) preallocatedMemoryCheckRec(s *[]bool, t TreeNodeIndex) {
+
+	// We don't need recursive ending, because there will be no children anyway.
+	(*s)[t] = true
+	for i := 0; i < tree.treeNodes[t].cCount; i++ {
+		tree.preallocatedMemoryCheckRec(s, tree.treeNodes[t].children[i].child)
+	}
+
+}
+
+// cachedMemoryCheck runs though memory cache and fills s with usage info
+func (tree *Tree23) cachedMemoryCheck(s *[]bool) {
+	for _, n := range tree.treeNodesFreePositions {
+		(*s)[n] = true
+	}
+}
+
+// memoryCheck goes through all preallocated memory and checks, wether it is actually in use or unrachable
+// Returns true, if everything is OK.
+func (tree *Tree23) memoryCheck() bool {
+
+	// Should be initialized as false.
+	s := make([]bool, tree.treeNodesFirstFreePos, tree.treeNodesFirstFreePos)
+
+	tree.preallocatedMemoryCheckRec(&s, tree.root)
+	tree.cachedMemoryCheck(&s)
+
+	allMemoryReachable := true
+	for _, n := range s {
+		allMemoryReachable = allMemoryReachable && n
+	}
+
+	return allMemoryReachable
+
+}
+
+// CheckFreeListDisjoint checks, that no node in the stack of recycled nodes is still reachable from the root.
+// Such a node would be handed out again by the next insert while it is in use.
+// Returns false and the first such node, if there is one. Otherwise true and -1 are returned.
+// Runs in O(n)
+func (tree *Tree23) CheckFreeListDisjoint() (bool, TreeNodeIndex) {
+	reachable := make([]bool, tree.treeNodesFirstFreePos)
+	tree.preallocatedMemoryCheckRec(&reachable, tree.root)
+	for _, n := range tree.treeNodesFreePositions {
+		if n >= 0 && int(n) < len(reachable) && reachable[n] {
+			return false, n
+		}
+	}
+	return true, -1
+}
+
+// CheckOrdering walks the leaf list and checks, that no element has a smaller value than its predecessor.
+// The values are taken freshly from the elements, so this finds keys changed with ChangeValueUnsafe.
+// Returns false and the first leaf with a value smaller than its predecessor, if the order is broken.
+// Otherwise true and -1 are returned.
+// Runs in O(n)
+func (tree *Tree23) CheckOrdering() (bool, TreeNodeIndex) {
+	if tree.IsEmpty(tree.root) {
+		return true, -1
+	}
+	smallest, _ := tree.GetSmallestLeaf()
+	last := tree.key(tree.treeNodes[smallest].elem)
+	for l := tree.treeNodes[smallest].next; l != smallest; l = tree.treeNodes[l].next {
+		k := tree.key(tree.treeNodes[l].elem)
+		if k < last {
+			return false, l
+		}
+		last = k
+	}
+	return true, -1
+}
+
+// countNodesRec returns the number of nodes in t, including t itself.
+func (tree *Tree23) countNodesRec(t TreeNodeIndex) int {
+	count := 1
+	for i := 0; i < tree.treeNodes[t].cCount; i++ {
+		count += tree.countNodesRec(tree.treeNodes[t].children[i].child)
+	}
+	return count
+}
+
+// MemoryReport returns the number of nodes reachable from the root, the number of recycled nodes
+// waiting for reuse and the number of nodes allocated in total.
+// For a healthy tree, reachable + free == allocated.
+// Runs in O(n)
+func (tree *Tree23) MemoryReport() (reachable, free, allocated int) {
+	return tree.countNodesRec(tree.root), tree.treeNodesFreePositions.len(), tree.treeNodesFirstFreePos
+}
+
+// arityRec counts the 2-nodes, 3-nodes and leaves in t.
+func (tree *Tree23) arityRec(t TreeNodeIndex, twoNodes, threeNodes, leaves *int) {
+	switch tree.treeNodes[t].cCount {
+	case 0:
+		*leaves++
+		return
+	case 2:
+		*twoNodes++
+	case 3:
+		*threeNodes++
+	}
+	for i := 0; i < tree.treeNodes[t].cCount; i++ {
+		tree.arityRec(tree.treeNodes[t].children[i].child, twoNodes, threeNodes, leaves)
+	}
+}
+
+// NodeArityHistogram returns the number of inner nodes with two and with three children and the number of leaves.
+// More 3-nodes make the tree less deep.
+// Runs in O(n)
+func (tree *Tree23) NodeArityHistogram() (twoNodes, threeNodes, leaves int) {
+	if tree.IsEmpty(tree.root) {
+		return 0, 0, 0
+	}
+	tree.arityRec(tree.root, &twoNodes, &threeNodes, &leaves)
+	return
+}
+
+// Stats contains structural information about a tree.
+type Stats struct {
+	// Number of elements in the tree.
+	Len int
+	// Depth of the tree, counting the leaf level. 0 for an empty tree.
+	Depth int
+	// Number of inner nodes with two and three children.
+	TwoNodes   int
+	ThreeNodes int
+	// Nodes reachable from the root, recycled nodes and all allocated nodes (see MemoryReport).
+	ReachableNodes int
+	FreeNodes      int
+	AllocatedNodes int
+}
+
+// Stats returns structural information about the tree.
+// Runs in O(n)
+func (tree *Tree23) Stats() Stats {
+	var s Stats
+	s.Len = tree.length
+	s.Depth, _ = tree.Depths()
+	s.TwoNodes, s.ThreeNodes, _ = tree.NodeArityHistogram()
+	s.ReachableNodes, s.FreeNodes, s.AllocatedNodes = tree.MemoryReport()
+	return s
+}
+
+// Invariant checks the tree on validity.
+// Returns true, if everything is OK with the given tree.
+// Three things are checked: If the minimum and maximum depth is equal for every node up to the root.
+// Further, the linked list for the leaf nodes is checked for valid increasing order and linking
+// Including the link from the last to the first element.
+// And the cached maximum of every child is checked with CheckMaxChildren.
+// The memory is checked for unused nodes, that are not recycled, and with CheckFreeListDisjoint.
+// Runs in O(n)
+func (tree *Tree23) Invariant() bool {
+	depthMin, depthMax := tree.Depths()
+
+	linkedListCorrect := tree.leafListInvariant()
+	maxChildrenCorrect, _ := tree.CheckMaxChildren()
+	freeListCorrect, _ := tree.CheckFreeListDisjoint()
+
+	return depthMin == depthMax && linkedListCorrect && maxChildrenCorrect && freeListCorrect && tree.memoryCheck()
+}
+
+// checkMaxChildrenRec returns the largest key in t, computed from the leaves, and the first node
+// below t (including t) with a wrong cached maximum or -1.
+func (tree *Tree23) checkMaxChildrenRec(t TreeNodeIndex) (float64, TreeNodeIndex) {
+	if tree.IsLeaf(t) {
+		return tree.leafKey(t), -1
+	}
+	var max float64
+	for i := 0; i < tree.treeNodes[t].cCount; i++ {
+		m, bad := tree.checkMaxChildrenRec(tree.treeNodes[t].children[i].child)
+		if bad != -1 {
+			return m, bad
+		}
+		if m != tree.treeNodes[t].children[i].maxChild {
+			return m, t
+		}
+		max = m
+	}
+	return max, -1
+}
+
+// CheckMaxChildren recomputes the largest value below every child of all inner nodes from the leaves
+// and compares it to the maximum cached in the node, that is used to navigate the tree.
+// Returns false and the first inner node with a wrong maximum, if any. Otherwise true and -1 are returned.
+// The values cached in the leaves are used, see CheckOrdering for checking the elements themselves.
+// Runs in O(n)
+func (tree *Tree23) CheckMaxChildren() (bool, TreeNodeIndex) {
+	if tree.IsEmpty(tree.root) {
+		return true, -1
+	}
+	_, bad := tree.checkMaxChildrenRec(tree.root)
+	return bad == -1, bad
+}
+
+// SetInvariantChecks enables or disables checking the tree after every Insert and Delete (including their variants
+// like InsertWithKey or DeleteNode). If the tree is broken after an operation, it panics with the operation and element.
+// This is only meant for debugging and tests, as every check runs in O(n). It is disabled by default.
+func (tree *Tree23) SetInvariantChecks(enabled bool) {
+	tree.invariantChecks = enabled
+}
+
+// SetAutoRepair enables or disables checking the leaf list with CheckLeafList after every Delete and DeleteNode.
+// A broken list is repaired like with RepairLeafList and the repair is reported to the logger set with SetRepairLogger.
+// This is a safety net while looking for the cause of a broken list, as every check runs in O(n). It is disabled by default.
+func (tree *Tree23) SetAutoRepair(enabled bool) {
+	tree.autoRepair = enabled
+}
+
+// SetRepairLogger sets a function, that gets a message for every repair of the leaf list by SetAutoRepair.
+// A nil logger disables the messages.
+func (tree *Tree23) SetRepairLogger(logger func(msg string)) {
+	tree.repairLogger = logger
+}
+
+// repairLeafList repairs the leaf list, if auto repair is enabled and the list is broken after the operation op with elem.
+func (tree *Tree23) repairLeafList(op string, elem TreeElement) {
+	if !tree.autoRepair || tree.CheckLeafList() {
+		return
+	}
+	tree.relinkLeaves()
+	if tree.repairLogger != nil {
+		tree.repairLogger(fmt.Sprintf("tree23: repaired the leaf list after %v(%v)", op, elem))
+	}
+}
+
+// checkInvariant panics, if invariant checks are enabled and the tree is broken after the operation op with elem.
+func (tree *Tree23) checkInvariant(op string, elem TreeElement) {
+	if !tree.invariantChecks {
+		return
+	}
+	if !tree.Invariant() {
+		panic(fmt.Sprintf("Tree invariant is broken after %v(%v).", op, elem))
+	}
+	if ok, l := tree.CheckOrdering(); !ok {
+		panic(fmt.Sprintf("Tree ordering is broken at leaf %v after %v(%v).", l, op, elem))
+	}
+}
+
+// walkRec is the recursive function for Walk.
+func (tree *Tree23) walkRec(t TreeNodeIndex, level int, maxChild float64, visit func(level int, isLeaf bool, idx TreeNodeIndex, maxChild float64)) {
+	leaf := tree.IsLeaf(t)
+	visit(level, leaf, t, tree.keyOf(maxChild))
+	if leaf {
+		return
+	}
+	for i := 0; i < tree.treeNodes[t].cCount; i++ {
+		c := tree.treeNodes[t].children[i]
+		tree.walkRec(c.child, level+1, c.maxChild, visit)
+	}
+}
+
+// Walk calls visit for every node of the tree in pre-order, starting with the root on level 0.
+// maxChild is the value of the largest leaf below the node, as cached in its parent.
+// Nothing is visited for an empty tree.
+// Runs in O(n)
+func (tree *Tree23) Walk(visit func(level int, isLeaf bool, idx TreeNodeIndex, maxChild float64)) {
+	if tree.IsEmpty(tree.root) {
+		return
+	}
+	tree.walkRec(tree.root, 0, tree.max(tree.root), visit)
+}
+
+// walkInternalRec is the recursive function for WalkInternal. maxKey is the largest key in t.
+func (tree *Tree23) walkInternalRec(t TreeNodeIndex, maxKey float64, level int, visit func(idx TreeNodeIndex, minKey, maxKey float64, level int) bool) {
+	if tree.IsLeaf(t) {
+		return
+	}
+	// The sum of the heights of all nodes is in O(n), so finding the smallest leaf for every node is as well.
+	smallest, _ := tree.getSmallestLeafRec(t)
+	low, high := tree.keyOf(tree.leafKey(smallest)), tree.keyOf(maxKey)
+	if tree.descending {
+		low, high = high, low
+	}
+	if !visit(t, low, high, level) {
+		return
+	}
+	for i := 0; i < tree.treeNodes[t].cCount; i++ {
+		c := tree.treeNodes[t].children[i]
+		tree.walkInternalRec(c.child, c.maxChild, level+1, visit)
+	}
+}
+
+// WalkInternal calls visit for every inner node of the tree in pre-order, starting with the root on level 0.
+// minKey and maxKey are the smallest and largest value of all elements below the node.
+// If visit returns false, the children of that node are skipped.
+// Leaves are not visited.
+// Runs in O(n)
+func (tree *Tree23) WalkInternal(visit func(idx TreeNodeIndex, minKey, maxKey float64, level int) bool) {
+	if tree.IsEmpty(tree.root) {
+		return
+	}
+	tree.walkInternalRec(tree.root, tree.max(tree.root), 0, visit)
+}
+
+// ForEachLevel visits the tree breadth-first. visit is called once for every level, starting with the root on level 0,
+// and gets all nodes of that level from left to right. The leaves are the last level.
+// nodes is reused for the next level and must not be kept after visit returns.
+// Nothing is visited for an empty tree.
+// Runs in O(n)
+func (tree *Tree23) ForEachLevel(visit func(level int, nodes []TreeNodeIndex)) {
+	if tree.IsEmpty(tree.root) {
+		return
+	}
+
+	nodes := []TreeNodeIndex{tree.root}
+	var next []TreeNodeIndex
+	for level := 0; len(nodes) > 0; level++ {
+		visit(level, nodes)
+
+		next = next[:0]
+		for _, n := range nodes {
+			for i := 0; i < tree.treeNodes[n].cCount; i++ {
+				next = append(next, tree.treeNodes[n].children[i].child)
+			}
+		}
+		nodes, next = next, nodes
+	}
+}
+
+// LevelSizes returns the number of nodes on each level of the tree, starting with the root level.
+// The last entry is the number of leaves. An empty tree returns an empty slice.
+// Runs in O(n)
+func (tree *Tree23) LevelSizes() []int {
+	sizes := []int{}
+	tree.ForEachLevel(func(level int, nodes []TreeNodeIndex) {
+		sizes = append(sizes, len(nodes))
+	})
+	return sizes
+}
+
+// rangeWalkRec is the recursive function for RangeWalk. All keys in t are not smaller than lowerBound.
+// Returns false, if visit stopped the walk.
+func (tree *Tree23) rangeWalkRec(t TreeNodeIndex, lowerBound, low, high float64, visit func(TreeElement) bool) bool {
+	if tree.IsLeaf(t) {
+		k := tree.leafKey(t)
+		if k < low || k > high {
+			return true
+		}
+		return visit(tree.treeNodes[t].elem)
+	}
+	for i := 0; i < tree.treeNodes[t].cCount; i++ {
+		c := tree.treeNodes[t].children[i]
+		if i > 0 {
+			lowerBound = tree.treeNodes[t].children[i-1].maxChild
+		}
+		if lowerBound > high {
+			return true
+		}
+		if c.maxChild >= low && !tree.rangeWalkRec(c.child, lowerBound, low, high, visit) {
+			return false
+		}
+	}
+	return true
+}
+
+// RangeWalk calls visit for all elements with a value within [low, high] in sorted order, until visit returns false.
+// Only subtrees that overlap with [low, high] are descended into, so the leaf list is not used at all.
+// Runs in O(log(n) + k) for k elements within [low, high]
+func (tree *Tree23) RangeWalk(low, high float64, visit func(TreeElement) bool) {
+	if tree.IsEmpty(tree.root) {
+		return
+	}
+	lowKey, highKey := tree.keyOf(low), tree.keyOf(high)
+	if tree.descending {
+		lowKey, highKey = highKey, lowKey
+	}
+	tree.rangeWalkRec(tree.root, math.Inf(-1), lowKey, highKey, visit)
+}
+
+// pprintIndentation writes the indentation of one line of FprintWith to w.
+func pprintIndentation(w io.Writer, indentation int, bar bool) {
+	if indentation != 0 {
+		fmt.Fprintf(w, "  ")
+	}
+	for i := 0; i < indentation-1; i++ {
+		fmt.Fprintf(w, "|  ")
+	}
+	if bar {
+		fmt.Fprintf(w, "|")
+	}
+}
+
+// FprintWith writes the tree in the indented form of PrettyPrint to w.
+// Internal nodes show their cached maximum child value and leaves show their own element
+// and the elements of their neighbours, each rendered by format.
+// Runs in O(n log(n))
+func (tree *Tree23) FprintWith(w io.Writer, format func(TreeElement) string) {
+	tree.Walk(func(level int, isLeaf bool, t TreeNodeIndex, maxChild float64) {
+		if level > 0 {
+			pprintIndentation(w, level-1, level > 1)
+			fmt.Fprintf(w, "--%.0f\n", maxChild)
+		}
+		if isLeaf {
+			pprintIndentation(w, level, true)
+			fmt.Fprintf(w, "--(prev: %v. value: %v. next: %v)\n",
+				format(tree.treeNodes[tree.treeNodes[t].prev].elem),
+				format(tree.treeNodes[t].elem),
+				format(tree.treeNodes[tree.treeNodes[t].next].elem))
+		}
+	})
+	fmt.Fprintf(w, "\n")
+}
+
+// PrettyPrint pretty prints the tree so it can be visually validated or understood.
+// Runs in O(n log(n))
+func (tree *Tree23) PrettyPrint() {
+	tree.FprintWith(os.Stdout, func(e TreeElement) string {
+		return fmt.Sprintf("%.2f", e.ExtractValue())
+	})
+}
+
+// WriteCSV writes one CSV record per element in sorted order to w.
+// The fields of each record are created by fieldFn.
+// Runs in O(n)
+func (tree *Tree23) WriteCSV(w io.Writer, fieldFn func(TreeElement) []string) error {
+
+	cw := csv.NewWriter(w)
+
+	if !tree.IsEmpty(tree.root) {
+		smallest, _ := tree.GetSmallestLeaf()
+		for l := smallest; ; {
+			if err := cw.Write(fieldFn(tree.treeNodes[l].elem)); err != nil {
+				return err
+			}
+			l = tree.treeNodes[l].next
+			if l == smallest {
+				break
+			}
+		}
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
+
+// walkFrom calls fn for all leaves in order, starting with the first leaf with a key not smaller than k.
+// The walk stops, if fn returns false or after the largest leaf.
+func (tree *Tree23) walkFrom(k float64, fn func(TreeNodeIndex) bool) {
+	if tree.IsEmpty(tree.root) {
+		return
+	}
+	l, err := tree.findFirstLargerLeafRec(tree.root, k)
+	if err != nil {
+		return
+	}
+	smallest, _ := tree.GetSmallestLeaf()
+	for fn(l) {
+		l = tree.treeNodes[l].next
+		if l == smallest {
+			return
+		}
+	}
+}
+
+// ScanFrom calls fn for up to limit elements in sorted order, starting with the first element
+// with a value bigger or equal than v. The scan stops early, if fn returns false.
+// It never wraps around from the largest to the smallest element.
+// Runs in O(log(n) + limit)
+func (tree *Tree23) ScanFrom(v float64, limit int, fn func(TreeElement) bool) {
+	if limit <= 0 {
+		return
+	}
+	count := 0
+	tree.walkFrom(tree.keyOf(v), func(l TreeNodeIndex) bool {
+		count++
+		return fn(tree.treeNodes[l].elem) && count < limit
+	})
+}
+
+// RangeChannel returns a channel with a buffer of buf elements, that receives all elements with a value
+// within [low, high] in sorted order and is closed afterwards. The elements are sent by a new goroutine.
+// The channel must be read by a single consumer until it is closed, otherwise the goroutine never ends.
+// Use RangeChannelContext to be able to stop early. The tree must not be modified until the channel is closed.
+// Runs in O(log(n) + k) for k elements in the range
+func (tree *Tree23) RangeChannel(low, high float64, buf int) <-chan TreeElement {
+	return tree.RangeChannelContext(context.Background(), low, high, buf)
+}
+
+// RangeChannelContext works like RangeChannel, but stops sending and closes the channel, as soon as ctx is done.
+// A consumer can stop early by canceling ctx without leaking the goroutine.
+// Runs in O(log(n) + k) for k elements in the range
+func (tree *Tree23) RangeChannelContext(ctx context.Context, low, high float64, buf int) <-chan TreeElement {
+	ch := make(chan TreeElement, buf)
+	go func() {
+		defer close(ch)
+		tree.walkRange(low, high, func(l TreeNodeIndex) bool {
+			// select picks randomly, if ctx is done and the consumer is still receiving.
+			if ctx.Err() != nil {
+				return false
+			}
+			select {
+			case ch <- tree.treeNodes[l].elem:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		})
+	}()
+	return ch
+}
+
+// AnyInRange returns true, if pred is true for any element with a value within [low, high].
+// The scan stops at the first match. An empty range returns false.
+// Runs in O(log(n) + k) for k elements within [low, high]
+func (tree *Tree23) AnyInRange(low, high float64, pred func(TreeElement) bool) bool {
+	found := false
+	tree.walkRange(low, high, func(l TreeNodeIndex) bool {
+		found = pred(tree.treeNodes[l].elem)
+		return !found
+	})
+	return found
+}
+
+// AllInRange returns true, if pred is true for all elements with a value within [low, high].
+// The scan stops at the first element not matching. An empty range returns true.
+// Runs in O(log(n) + k) for k elements within [low, high]
+func (tree *Tree23) AllInRange(low, high float64, pred func(TreeElement) bool) bool {
+	all := true
+	tree.walkRange(low, high, func(l TreeNodeIndex) bool {
+		all = pred(tree.treeNodes[l].elem)
+		return all
+	})
+	return all
+}
+
+// walkRange calls fn for all leaves in order with a value within [low, high], until fn returns false.
+func (tree *Tree23) walkRange(low, high float64, fn func(TreeNodeIndex) bool) {
+	lowKey, highKey := tree.keyOf(low), tree.keyOf(high)
+	if tree.descending {
+		lowKey, highKey = highKey, lowKey
+	}
+	tree.walkFrom(lowKey, func(l TreeNodeIndex) bool {
+		return tree.leafKey(l) <= highKey && fn(l)
+	})
+}
+
+// clear removes all elements from the tree, but keeps the allocated memory for reuse.
+// Runs in O(n)
+func (tree *Tree23) clear() {
+
+	var removed []TreeElement
+	if !tree.IsEmpty(tree.root) && (tree.journal != nil || tree.onDelete != nil) {
+		smallest, _ := tree.GetSmallestLeaf()
+		for l := smallest; ; {
+			tree.writeJournal(journalDelete, tree.treeNodes[l].elem)
+			if tree.onDelete != nil {
+				removed = append(removed, tree.treeNodes[l].elem)
+			}
+			l = tree.treeNodes[l].next
+			if l == smallest {
+				break
+			}
+		}
+	}
+
+	tree.reset()
+
+	for _, e := range removed {
+		tree.onDelete(e)
+	}
+}
+
+// reset removes all nodes from the tree without journaling or calling any hooks.
+// Runs in O(n)
+func (tree *Tree23) reset() {
+	for i := 0; i < tree.treeNodesFirstFreePos; i++ {
+		var a [3]treeLink
+		tree.treeNodes[i] = treeNode{a, 0, nil, 0, -1, -1}
+	}
+	tree.root = 0
+	tree.length = 0
+	tree.minLeaf = -1
+	tree.treeNodesFirstFreePos = 1
+	tree.treeNodesFreePositions = tree.treeNodesFreePositions[:0]
+}
+
+// Clear removes all elements from the tree, but keeps the allocated memory for reuse.
+// Every removed element is journaled and passed to the delete hook.
+// Runs in O(n)
+func (tree *Tree23) Clear() {
+	tree.beginMutation()
+	tree.clear()
+}
+
+// Release removes all elements from the tree like Clear, but also frees the allocated memory.
+// The tree starts again with the minimal memory of a tree from New. This is useful, if the tree
+// was large before and will stay small or unused for a while.
+// Runs in O(n)
+func (tree *Tree23) Release() {
+	tree.beginMutation()
+	tree.clear()
+	tree.initializeTree(1)
+}
+
+// sortedKeys returns the keys of elems, whether they are sorted in the order of the tree.
+func (tree *Tree23) sortedKeys(elems []TreeElement) ([]float64, bool) {
+	keys := make([]float64, len(elems))
+	sorted := true
+	for i, e := range elems {
+		keys[i] = tree.key(e)
+		sorted = sorted && (i == 0 || keys[i-1] <= keys[i])
+	}
+	return keys, sorted
+}
+
+// groupEqual reorders runs of elements with the same key in place, so that equal elements are next to each other,
+// like Insert keeps them. The first occurrences keep their order.
+func groupEqual(elems []TreeElement, keys []float64) {
+	for start := 0; start < len(elems); {
+		end := start + 1
+		for end < len(elems) && keys[end] == keys[start] {
+			end++
+		}
+		for i := start; i < end-1; i++ {
+			// Move all elements equal to elems[i] directly behind it.
+			next := i + 1
+			for j := i + 1; j < end; j++ {
+				if elems[i].Equal(elems[j]) {
+					e := elems[j]
+					copy(elems[next+1:j+1], elems[next:j])
+					elems[next] = e
+					next++
+				}
+			}
+			i = next - 1
+		}
+		start = end
+	}
+}
+
+// dropEqual removes every element, that is equal to its predecessor, in place and returns the shortened slices.
+// Equal elements have to be next to each other. See groupEqual.
+func dropEqual(elems []TreeElement, keys []float64) ([]TreeElement, []float64) {
+	n := 0
+	for i := range elems {
+		if n > 0 && keys[i] == keys[n-1] && elems[i].Equal(elems[n-1]) {
+			continue
+		}
+		elems[n], keys[n] = elems[i], keys[i]
+		n++
+	}
+	return elems[:n], keys[:n]
+}
+
+// orderTies orders runs of elements with the same key in place like Insert does.
+// Without a tie breaker, only equal elements are grouped. See groupEqual.
+func (tree *Tree23) orderTies(elems []TreeElement, keys []float64) {
+	groupEqual(elems, keys)
+	if tree.tieBreaker == nil {
+		return
+	}
+	for start := 0; start < len(elems); {
+		end := start + 1
+		for end < len(elems) && keys[end] == keys[start] {
+			end++
+		}
+		run := elems[start:end]
+		sort.SliceStable(run, func(i, j int) bool { return tree.tieBreaker(run[i], run[j]) })
+		start = end
+	}
+}
+
+// SetTieBreaker sets the order of elements with the same value. less is only called for elements with the same value
+// and has to be consistent with Equal: Equal elements must never be less than each other.
+// Elements with the same value are then sorted by less in the leaf list and Find can stop searching early.
+// If the tree is not empty, it is rebuilt in the new order and all node indices change. A nil function removes the tie breaker.
+// Runs in O(n log(n)) for a non-empty tree, O(1) otherwise
+func (tree *Tree23) SetTieBreaker(less func(a, b TreeElement) bool) {
+
+	tree.beginMutation()
+	tree.tieBreaker = less
+	if less == nil || tree.length < 2 {
+		return
+	}
+
+	leaves := tree.LeafIndices()
+	elems := make([]TreeElement, len(leaves))
+	keys := make([]float64, len(leaves))
+	for i, l := range leaves {
+		elems[i] = tree.treeNodes[l].elem
+		keys[i] = tree.treeNodes[l].key
+	}
+	tree.orderTies(elems, keys)
+	tree.reset()
+	tree.buildSorted(elems, keys)
+}
+
+// BuildFromSorted creates a new tree with all elements, that must be sorted in increasing order.
+// The tree is built bottom up without any comparisons between elements, which is much faster than inserting them.
+// An error is returned, if elems is not sorted.
+// Runs in O(n)
+func BuildFromSorted(elems []TreeElement) (*Tree23, error) {
+	tree := NewCapacity(2*len(elems) + 1)
+	keys, sorted := tree.sortedKeys(elems)
+	if !sorted {
+		return nil, errors.New("BuildFromSorted() needs sorted elements")
+	}
+	elems = append([]TreeElement(nil), elems...)
+	groupEqual(elems, keys)
+	tree.buildSorted(elems, keys)
+	return tree, nil
+}
+
+// BuildParallel creates a new tree with all elements, that don't need to be sorted. elems itself is never changed.
+// The elements are split into one part per worker, which are sorted concurrently and merged pairwise, also concurrently.
+// Only building the tree from the sorted elements is done by the calling goroutine.
+// Elements with the same value keep their order from elems, like with Replace. workers smaller than 1 are treated as 1.
+// Runs in O(n log(n)/workers + n log(workers))
+func BuildParallel(elems []TreeElement, workers int) *Tree23 {
+	tree := NewCapacity(2*len(elems) + 1)
+	workers = max(min(workers, len(elems)), 1)
+
+	sorted := elemsByKey{make([]TreeElement, len(elems)), make([]float64, len(elems))}
+	copy(sorted.elems, elems)
+
+	// Part i covers [bounds[i], bounds[i+1]).
+	bounds := make([]int, workers+1)
+	for i := range bounds {
+		bounds[i] = i * len(elems) / workers
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(part elemsByKey) {
+			defer wg.Done()
+			for j, e := range part.elems {
+				part.keys[j] = tree.key(e)
+			}
+			sort.Stable(part)
+		}(sorted.slice(bounds[i], bounds[i+1]))
+	}
+	wg.Wait()
+
+	buffer := elemsByKey{make([]TreeElement, len(elems)), make([]float64, len(elems))}
+	for len(bounds) > 2 {
+		merged := make([]int, 0, len(bounds)/2+1)
+		for i := 0; i+1 < len(bounds); i += 2 {
+			merged = append(merged, bounds[i])
+			if i+2 == len(bounds) {
+				// The last part has no partner in this round.
+				buffer.copyFrom(sorted, bounds[i], bounds[i+1])
+				continue
+			}
+			wg.Add(1)
+			go func(low, mid, high int) {
+				defer wg.Done()
+				buffer.merge(sorted, low, mid, high)
+			}(bounds[i], bounds[i+1], bounds[i+2])
+		}
+		wg.Wait()
+		bounds = append(merged, len(elems))
+		sorted, buffer = buffer, sorted
+	}
+
+	groupEqual(sorted.elems, sorted.keys)
+	tree.buildSorted(sorted.elems, sorted.keys)
+	return tree
+}
+
+// Replace removes all elements from the tree and builds it from elems instead, reusing the allocated memory.
+// If elems is not sorted, a sorted copy is used. elems itself is never changed.
+// For a tree from NewSet, only the first of equal elements in elems is inserted.
+// All removed and inserted elements are journaled and passed to the hooks.
+// Runs in O(n + k) for sorted elems and O(n + k log(k)) otherwise
+func (tree *Tree23) Replace(elems []TreeElement) {
+
+	tree.beginMutation()
+
+	elems = append([]TreeElement(nil), elems...)
+	keys, sorted := tree.sortedKeys(elems)
+	if !sorted {
+		sort.Stable(elemsByKey{elems, keys})
+	}
+	tree.orderTies(elems, keys)
+	if tree.unique {
+		elems, keys = dropEqual(elems, keys)
+	}
+
+	tree.clear()
+	for _, e := range elems {
+		tree.writeJournal(journalInsert, e)
+	}
+	tree.buildSorted(elems, keys)
+
+	if tree.onInsert != nil {
+		for _, e := range elems {
+			tree.onInsert(e)
+		}
+	}
+}
+
+// elemsByKey sorts elements together with their keys.
+type elemsByKey struct {
+	elems []TreeElement
+	keys  []float64
+}
+
+func (s elemsByKey) Len() int           { return len(s.elems) }
+func (s elemsByKey) Less(i, j int) bool { return s.keys[i] < s.keys[j] }
+func (s elemsByKey) Swap(i, j int) {
+	s.elems[i], s.elems[j] = s.elems[j], s.elems[i]
+	s.keys[i], s.keys[j] = s.keys[j], s.keys[i]
+}
+
+// slice returns the elements and keys within [low, high).
+func (s elemsByKey) slice(low, high int) elemsByKey {
+	return elemsByKey{s.elems[low:high], s.keys[low:high]}
+}
+
+// copyFrom copies the elements and keys within [low, high) of src to the same positions in s.
+func (s elemsByKey) copyFrom(src elemsByKey, low, high int) {
+	copy(s.elems[low:high], src.elems[low:high])
+	copy(s.keys[low:high], src.keys[low:high])
+}
+
+// merge merges the sorted parts [low, mid) and [mid, high) of src into [low, high) of s.
+// For equal keys, elements of the first part come first.
+func (s elemsByKey) merge(src elemsByKey, low, mid, high int) {
+	i, j := low, mid
+	for k := low; k < high; k++ {
+		if j == high || i < mid && src.keys[i] <= src.keys[j] {
+			s.elems[k], s.keys[k] = src.elems[i], src.keys[i]
+			i++
+		} else {
+			s.elems[k], s.keys[k] = src.elems[j], src.keys[j]
+			j++
+		}
+	}
+}
+
+// buildSorted builds the tree bottom up from elems with the given keys, that must be sorted in the order of the tree.
+// The tree must be empty. No journal is written and no hooks are called.
+// Runs in O(n)
+func (tree *Tree23) buildSorted(elems []TreeElement, keys []float64) {
+	if len(elems) == 0 {
+		return
+	}
+
+	// The leaves are linked after the tree is complete.
+	level := make([]TreeNodeIndex, len(elems))
+	for i, e := range elems {
+		level[i] = tree.newLeaf(e, keys[i], -1, -1)
+	}
+
+	// Group the nodes of every level into parents with three children.
+	// The last one or two parents get two children, so no parent is left with a single child.
+	for len(level) > 1 {
+		parents := make([]TreeNodeIndex, 0, len(level)/2+1)
+		for i := 0; i < len(level); {
+			size := 3
+			if rest := len(level) - i; rest == 2 || rest == 4 {
+				size = 2
+			}
+			parents = append(parents, tree.nodeFromChildrenList(&level, i, i+size))
+			i += size
+		}
+		level = parents
+	}
+
+	tree.recycleNode(tree.root)
+	tree.root = level[0]
+	tree.length = len(elems)
+	tree.relinkLeaves()
+}
+
+// SetTextFormat sets the conversion of elements used by MarshalText and UnmarshalText.
+// format creates the text for one element. If it is nil, the value of the element is written.
+// factory creates an element from a value read by UnmarshalText.
+func (tree *Tree23) SetTextFormat(format func(TreeElement) string, factory func(float64) TreeElement) {
+	tree.textFormat = format
+	tree.textFactory = factory
+}
+
+// SetTextParser sets the inverse of a custom format from SetTextFormat. UnmarshalText calls parse for every line
+// instead of reading a value, so trees with a custom format can be read back. parse gets the line without
+// surrounding white space. A nil parser reads values again.
+func (tree *Tree23) SetTextParser(parse func(line string) (TreeElement, error)) {
+	tree.textParse = parse
+}
+
+// MarshalText implements encoding.TextMarshaler. All elements are written in sorted order, one per line.
+// Each line contains the text from the format set with SetTextFormat or the value of the element.
+// An error is returned, if a custom format creates a text with a line break.
+// Runs in O(n)
+func (tree *Tree23) MarshalText() ([]byte, error) {
+
+	var b []byte
+	if tree.IsEmpty(tree.root) {
+		return b, nil
+	}
+
+	smallest, _ := tree.GetSmallestLeaf()
+	for l := smallest; ; {
+		e := tree.treeNodes[l].elem
+		if tree.textFormat != nil {
+			text := tree.textFormat(e)
+			if strings.ContainsAny(text, "\r\n") {
+				return nil, errors.New("MarshalText() needs a format without line breaks")
+			}
+			b = append(b, text...)
+		} else {
+			b = strconv.AppendFloat(b, e.ExtractValue(), 'g', -1, 64)
+		}
+		b = append(b, '\n')
+
+		l = tree.treeNodes[l].next
+		if l == smallest {
+			break
+		}
+	}
+	return b, nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler. It replaces all elements in the tree with elements
+// created by the parser set with SetTextParser from the lines of text. Without a parser, every line has to be a value,
+// that is passed to the factory set with SetTextFormat. A tree with a custom format needs a parser.
+// If text can not be parsed, an error is returned and the tree is not changed.
+// Runs in O(n log(n))
+func (tree *Tree23) UnmarshalText(text []byte) error {
+
+	tree.beginMutation()
+
+	if tree.textParse == nil && tree.textFormat != nil {
+		return errors.New("UnmarshalText() needs a parser set with SetTextParser for a custom format")
+	}
+	if tree.textParse == nil && tree.textFactory == nil {
+		return errors.New("UnmarshalText() needs a factory set with SetTextFormat")
+	}
+
+	var elems []TreeElement
+	for i, line := range strings.Split(string(text), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if tree.textParse != nil {
+			e, err := tree.textParse(line)
+			if err != nil {
+				return fmt.Errorf("UnmarshalText() line %d: %v", i+1, err)
+			}
+			elems = append(elems, e)
+			continue
+		}
+		v, err := strconv.ParseFloat(line, 64)
+		if err != nil {
+			return fmt.Errorf("UnmarshalText() line %d: %v", i+1, err)
+		}
+		elems = append(elems, tree.textFactory(v))
+	}
+
+	tree.clear()
+	for _, e := range elems {
+		tree.Insert(e)
+	}
+	return nil
+}
+
+// RegisterElementType registers a factory for UnmarshalBinary, that creates an element of the type name from its binary encoding.
+// name is the name of the Go type as written by fmt with %T, like "main.Point" or "*main.Point".
+// MarshalBinary writes this name for every element, so trees with different element types can be decoded.
+func (tree *Tree23) RegisterElementType(name string, factory func([]byte) (TreeElement, error)) {
+	// Copies of the tree share the map, so it is never changed in place.
+	types := make(map[string]func([]byte) (TreeElement, error), len(tree.elementTypes)+1)
+	for n, f := range tree.elementTypes {
+		types[n] = f
+	}
+	types[name] = factory
+	tree.elementTypes = types
+}
+
+// Identifies the format of MarshalBinary.
+const binaryMagic = "T23B1"
+
+// MarshalBinary implements encoding.BinaryMarshaler. All elements are written in sorted order, each with the name
+// of its type (see RegisterElementType) and its own binary encoding. Elements have to implement encoding.BinaryMarshaler.
+// Runs in O(n)
+func (tree *Tree23) MarshalBinary() ([]byte, error) {
+
+	b := []byte(binaryMagic)
+	b = binary.AppendUvarint(b, uint64(tree.length))
+	for _, e := range tree.ToSlice() {
+		m, ok := e.(encoding.BinaryMarshaler)
+		if !ok {
+			return nil, fmt.Errorf("TreeElement of type %T does not implement encoding.BinaryMarshaler", e)
+		}
+		data, err := m.MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		name := fmt.Sprintf("%T", e)
+		b = binary.AppendUvarint(b, uint64(len(name)))
+		b = append(b, name...)
+		b = binary.AppendUvarint(b, uint64(len(data)))
+		b = append(b, data...)
+	}
+	return b, nil
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler. It replaces all elements in the tree with the elements
+// written by MarshalBinary. Every element is created by the factory registered for its type with RegisterElementType.
+// If data can not be decoded or a type is not registered, an error is returned and the tree is not changed.
+// Runs in O(n log(n))
+func (tree *Tree23) UnmarshalBinary(data []byte) error {
+
+	tree.beginMutation()
+
+	if !strings.HasPrefix(string(data), binaryMagic) {
+		return errors.New("UnmarshalBinary() got data without the header of MarshalBinary")
+	}
+	r := &structureReader{data: data[len(binaryMagic):]}
+
+	count := r.uvarint()
+	if count > uint64(len(data)) {
+		r.fail()
+	}
+	var elems []TreeElement
+	for i := uint64(0); i < count && r.err == nil; i++ {
+		name := string(r.bytes(r.uvarint()))
+		encoded := r.bytes(r.uvarint())
+		if r.err != nil {
+			break
+		}
+		factory, ok := tree.elementTypes[name]
+		if !ok {
+			return fmt.Errorf("UnmarshalBinary() found elements of type %q, that is not registered with RegisterElementType", name)
+		}
+		e, err := factory(encoded)
+		if err != nil {
+			return err
+		}
+		elems = append(elems, e)
+	}
+	if r.err == nil && len(r.data) > 0 {
+		r.fail()
+	}
+	if r.err != nil {
+		return errors.New("UnmarshalBinary() got invalid or incomplete data")
+	}
+
+	tree.Replace(elems)
+	return nil
+}
+
+// DumpStructure encodes the exact internal layout of the tree: All used nodes with their indices, children,
+// cached values and leaf links, the root and the stack of recycled nodes. LoadStructure restores exactly
+// this layout, which is useful to reproduce a bug from a captured tree. Elements have to implement
+// encoding.BinaryMarshaler. Dumping a loaded tree again results in the same bytes.
+// Runs in O(n)
+func (tree *Tree23) DumpStructure() ([]byte, error) {
+
+	b := []byte(structureMagic)
+	b = binary.AppendUvarint(b, uint64(tree.modeFlags()))
+	b = binary.AppendVarint(b, int64(tree.root))
+	b = binary.AppendUvarint(b, uint64(tree.length))
+	b = binary.AppendVarint(b, int64(tree.minLeaf))
+	b = binary.AppendUvarint(b, uint64(structureCapacity(tree.treeNodesFirstFreePos, len(tree.treeNodes))))
+	b = binary.AppendUvarint(b, uint64(tree.treeNodesFirstFreePos))
+
+	b = binary.AppendUvarint(b, uint64(len(tree.treeNodesFreePositions)))
+	for _, n := range tree.treeNodesFreePositions {
+		b = binary.AppendVarint(b, int64(n))
+	}
+
+	for i := 0; i < tree.treeNodesFirstFreePos; i++ {
+		n := &tree.treeNodes[i]
+		b = binary.AppendUvarint(b, uint64(n.cCount))
+		for c := 0; c < n.cCount; c++ {
+			b = binary.LittleEndian.AppendUint64(b, math.Float64bits(n.children[c].maxChild))
+			b = binary.AppendVarint(b, int64(n.children[c].child))
+		}
+		b = binary.LittleEndian.AppendUint64(b, math.Float64bits(n.key))
+		b = binary.AppendVarint(b, int64(n.prev))
+		b = binary.AppendVarint(b, int64(n.next))
+
+		if n.elem == nil {
+			b = append(b, 0)
+			continue
+		}
+		m, ok := n.elem.(encoding.BinaryMarshaler)
+		if !ok {
+			return nil, errors.New("TreeElement does not implement encoding.BinaryMarshaler")
+		}
+		data, err := m.MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		b = append(b, 1)
+		b = binary.AppendUvarint(b, uint64(len(data)))
+		b = append(b, data...)
+	}
+	return b, nil
+}
+
+// Identifies the format of DumpStructure.
+const structureMagic = "T23S1"
+
+// Smallest encoding of one node in DumpStructure: The number of children, the key, both links and the element marker.
+const structureMinNodeSize = 12
+
+// Number of allocated nodes, that DumpStructure records at least, if the tree has that many.
+// Together with twice the used nodes, this limits the memory LoadStructure allocates for a small dump.
+const structureMinCapacity = 1 << 16
+
+// structureCapacity returns the number of allocated nodes recorded by DumpStructure for a tree with
+// used of size allocated nodes. Unused memory beyond that is not restored by LoadStructure.
+func structureCapacity(used, size int) int {
+	return min(size, max(2*used, structureMinCapacity))
+}
+
+// structureReader decodes the parts of a dump or binary encoding. After the first error, all reads return zero values.
+type structureReader struct {
+	data []byte
+	err  error
+}
+
+func (r *structureReader) fail() {
+	if r.err == nil {
+		r.err = errors.New("LoadStructure() got an invalid or incomplete dump")
+	}
+	r.data = nil
+}
+
+func (r *structureReader) uvarint() uint64 {
+	v, n := binary.Uvarint(r.data)
+	if n <= 0 {
+		r.fail()
+		return 0
+	}
+	r.data = r.data[n:]
+	return v
+}
+
+func (r *structureReader) varint() int64 {
+	v, n := binary.Varint(r.data)
+	if n <= 0 {
+		r.fail()
+		return 0
+	}
+	r.data = r.data[n:]
+	return v
+}
+
+func (r *structureReader) bytes(n uint64) []byte {
+	if uint64(len(r.data)) < n {
+		r.fail()
+		return nil
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *structureReader) float() float64 {
+	b := r.bytes(8)
+	if b == nil {
+		return 0
+	}
+	return math.Float64frombits(binary.LittleEndian.Uint64(b))
+}
+
+// index reads a node index, that must be smaller than size. -1 is allowed, if allowNone is set.
+func (r *structureReader) index(size int, allowNone bool) TreeNodeIndex {
+	i := r.varint()
+	if i >= int64(size) || i < 0 && !(allowNone && i == -1) {
+		r.fail()
+		return -1
+	}
+	return TreeNodeIndex(i)
+}
+
+// LoadStructure creates a tree with exactly the layout encoded by DumpStructure.
+// makeElem creates an element from its binary encoding.
+// The layout is not checked to be a valid tree, so a broken tree can be loaded to debug it.
+// An error is returned, if data is not a complete dump. The number of nodes is checked against the length of data
+// before any memory is allocated, so a small dump can not allocate a huge tree.
+// Runs in O(n)
+func LoadStructure(data []byte, makeElem func([]byte) TreeElement) (*Tree23, error) {
+
+	if !strings.HasPrefix(string(data), structureMagic) {
+		return nil, errors.New("LoadStructure() got data without the header of DumpStructure")
+	}
+	r := &structureReader{data: data[len(structureMagic):]}
+
+	flags := r.uvarint()
+	root := r.varint()
+	length := r.uvarint()
+	minLeaf := r.varint()
+	size := r.uvarint()
+	used := r.uvarint()
+	if r.err != nil || used < 1 || used > size || used > uint64(len(r.data)/structureMinNodeSize) ||
+		size != uint64(structureCapacity(int(used), int(size))) {
+		return nil, errors.New("LoadStructure() got an invalid or incomplete dump")
+	}
+
+	tree := NewCapacity(int(size))
+	tree.setModeFlags(byte(flags))
+	tree.treeNodesFirstFreePos = int(used)
+	tree.length = int(length)
+	if root < 0 || root >= int64(used) || minLeaf < -1 || minLeaf >= int64(used) {
+		r.fail()
+	}
+	tree.root = TreeNodeIndex(root)
+	tree.minLeaf = TreeNodeIndex(minLeaf)
+
+	free := r.uvarint()
+	if free > used {
+		r.fail()
+	}
+	for i := uint64(0); i < free && r.err == nil; i++ {
+		tree.treeNodesFreePositions.push(r.index(int(used), false))
+	}
+
+	for i := 0; i < int(used) && r.err == nil; i++ {
+		n := &tree.treeNodes[i]
+		n.cCount = int(r.uvarint())
+		if n.cCount > 3 {
+			r.fail()
+			break
+		}
+		for c := 0; c < n.cCount; c++ {
+			n.children[c].maxChild = r.float()
+			n.children[c].child = r.index(int(used), false)
+		}
+		n.key = r.float()
+		n.prev = r.index(int(used), true)
+		n.next = r.index(int(used), true)
+
+		switch hasElem := r.bytes(1); {
+		case hasElem == nil || hasElem[0] == 0:
+		case hasElem[0] == 1:
+			e := r.bytes(r.uvarint())
+			if r.err == nil {
+				n.elem = makeElem(e)
+			}
+		default:
+			r.fail()
+		}
+	}
+
+	if r.err == nil && len(r.data) > 0 {
+		r.fail()
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	return tree, nil
+}
+
+// Histogram counts the values of all elements within [min, max] in buckets bins of equal width.
+// Values outside of [min, max] are ignored. A value equal to max is counted in the last bin.
+// nil is returned, if buckets is not positive, min or max are infinite or max is not bigger than min.
+// Runs in O(log(n) + k) for k elements within [min, max]
+func (tree *Tree23) Histogram(min, max float64, buckets int) []int {
+	if buckets <= 0 || !(max > min) || math.IsInf(min, 0) || math.IsInf(max, 0) {
+		return nil
+	}
+
+	counts := make([]int, buckets)
+
+	// The range of keys to walk through in the order of the tree.
+	low, high := tree.keyOf(min), tree.keyOf(max)
+	if low > high {
+		low, high = high, low
+	}
+
+	if tree.IsEmpty(tree.root) {
+		return counts
+	}
+	start, err := tree.findFirstLargerLeafRec(tree.root, low)
+	if err != nil {
+		return counts
+	}
+	smallest, _ := tree.GetSmallestLeaf()
+
+	// max - min can overflow for huge ranges, half of it can not.
+	halfRange := max/2 - min/2
+	for l := start; ; {
+		if tree.leafKey(l) > high {
+			break
+		}
+		v := tree.treeNodes[l].elem.ExtractValue()
+		b := int((v/2 - min/2) / halfRange * float64(buckets))
+		if b >= buckets {
+			b = buckets - 1
+		}
+		counts[b]++
+
+		l = tree.treeNodes[l].next
+		// Once all around.
+		if l == smallest {
+			break
+		}
+	}
+	return counts
 }
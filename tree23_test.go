@@ -1,8 +1,15 @@
 package tree23
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
 	"fmt"
+	"math"
 	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 )
@@ -17,6 +24,14 @@ func (e Element) Equal(e2 TreeElement) bool {
 func (e Element) ExtractValue() float64 {
 	return float64(e.E)
 }
+func (e Element) MarshalBinary() ([]byte, error) {
+	return binary.AppendVarint(nil, int64(e.E)), nil
+}
+
+func makeElement(data []byte) TreeElement {
+	e, _ := binary.Varint(data)
+	return Element{int(e)}
+}
 
 func TestPreviousNext(t *testing.T) {
 	tree := New()
@@ -77,6 +92,78 @@ func TestFindFirstLargerLeaf(t *testing.T) {
 	}
 }
 
+func TestFindFirstStrictlyLargerLeaf(t *testing.T) {
+	tree := New()
+
+	for i := 0; i <= 20; i++ {
+		tree.Insert(Element{i})
+		tree.Insert(Element{i})
+	}
+
+	if e, err := tree.FindFirstStrictlyLargerLeaf(3.5); err != nil || !tree.GetValue(e).Equal(Element{4}) {
+		t.Fail()
+	}
+	if e, err := tree.FindFirstStrictlyLargerLeaf(-3.5); err != nil || !tree.GetValue(e).Equal(Element{0}) {
+		t.Fail()
+	}
+	for i := 0; i < 20; i++ {
+		e, err := tree.FindFirstStrictlyLargerLeaf(float64(i))
+		if err != nil || !tree.GetValue(e).Equal(Element{i + 1}) {
+			t.Fail()
+		}
+		// Must be the first leaf with that value.
+		if p, _ := tree.Previous(e); tree.GetValue(p).Equal(Element{i + 1}) {
+			t.Fail()
+		}
+	}
+	if _, err := tree.FindFirstStrictlyLargerLeaf(20.0); err == nil {
+		t.Fail()
+	}
+	if _, err := New().FindFirstStrictlyLargerLeaf(0); err == nil {
+		t.Fail()
+	}
+}
+
+func TestFindLastSmallerLeaf(t *testing.T) {
+	tree := New()
+
+	for _, v := range []int{1, 2, 2, 3} {
+		tree.Insert(Element{v})
+	}
+
+	first, _ := tree.FindFirstLargerLeaf(2)
+	last, _ := tree.Next(first)
+
+	if l, err := tree.FindLastSmallerOrEqualLeaf(2); err != nil || l != last {
+		t.Fail()
+	}
+	if l, err := tree.FindLastSmallerOrEqualLeaf(2.5); err != nil || l != last {
+		t.Fail()
+	}
+	if l, err := tree.FindLastSmallerOrEqualLeaf(10); err != nil || !tree.GetValue(l).Equal(Element{3}) {
+		t.Fail()
+	}
+	if _, err := tree.FindLastSmallerOrEqualLeaf(0.5); err == nil {
+		t.Fail()
+	}
+
+	if l, err := tree.FindLastSmallerLeaf(2); err != nil || !tree.GetValue(l).Equal(Element{1}) {
+		t.Fail()
+	}
+	if l, err := tree.FindLastSmallerLeaf(3); err != nil || l != last {
+		t.Fail()
+	}
+	if l, err := tree.FindLastSmallerLeaf(10); err != nil || !tree.GetValue(l).Equal(Element{3}) {
+		t.Fail()
+	}
+	if _, err := tree.FindLastSmallerLeaf(1); err == nil {
+		t.Fail()
+	}
+	if _, err := New().FindLastSmallerLeaf(1); err == nil {
+		t.Fail()
+	}
+}
+
 func TestFind(t *testing.T) {
 	tree := New()
 
@@ -157,7 +244,11 @@ func TestMemory(t *testing.T) {
 	}
 
 	var seed int64 = time.Now().UTC().UnixNano()
-	fmt.Printf("TestMemory Seed: %v\n", seed)
+	defer func() {
+		if t.Failed() {
+			t.Logf("Seed: %v", seed)
+		}
+	}()
 	r := rand.New(rand.NewSource(seed))
 
 	// Run insert and delete a lot!! Theoretically, we should be able
@@ -215,3 +306,4186 @@ func TestSmallestLargestLeaf(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestHistogram(t *testing.T) {
+	tree := New()
+
+	for i := 0; i < 100; i++ {
+		tree.Insert(Element{i})
+	}
+
+	h := tree.Histogram(10, 50, 4)
+	if len(h) != 4 || h[0] != 10 || h[1] != 10 || h[2] != 10 || h[3] != 11 {
+		t.Fail()
+	}
+	h = tree.Histogram(-100, 1000, 1)
+	if len(h) != 1 || h[0] != 100 {
+		t.Fail()
+	}
+	if tree.Histogram(5, 5, 3) != nil || tree.Histogram(0, 10, 0) != nil {
+		t.Fail()
+	}
+	if h := New().Histogram(0, 1, 2); len(h) != 2 || h[0] != 0 || h[1] != 0 {
+		t.Fail()
+	}
+
+	// The width of the whole range does not fit into a float64.
+	small := New()
+	for i := 0; i < 10; i++ {
+		small.Insert(Element{i})
+	}
+	h = small.Histogram(-math.MaxFloat64, math.MaxFloat64, 4)
+	if len(h) != 4 || h[0] != 0 || h[1] != 0 || h[2] != 10 || h[3] != 0 {
+		t.Fail()
+	}
+	h = small.Histogram(-math.MaxFloat64, math.MaxFloat64, 1)
+	if len(h) != 1 || h[0] != 10 {
+		t.Fail()
+	}
+}
+
+func TestLen(t *testing.T) {
+	tree := New()
+
+	for i := 0; i < 100; i++ {
+		tree.Insert(Element{i})
+	}
+	tree.Insert(Element{50})
+	if tree.Len() != 101 {
+		t.Fail()
+	}
+	tree.Delete(Element{50})
+	tree.Delete(Element{-1})
+	if tree.Len() != 100 {
+		t.Fail()
+	}
+	for i := 0; i < 100; i++ {
+		tree.Delete(Element{i})
+	}
+	if tree.Len() != 0 {
+		t.Fail()
+	}
+}
+
+func TestGetNthLeaf(t *testing.T) {
+	tree := New()
+
+	for i := 0; i < 100; i++ {
+		tree.Insert(Element{i * 2})
+	}
+
+	for i := 0; i < 100; i++ {
+		if l, err := tree.GetNthLeaf(i); err != nil || tree.GetValue(l).(Element).E != i*2 {
+			t.Fail()
+		}
+	}
+	if _, err := tree.GetNthLeaf(100); err == nil {
+		t.Fail()
+	}
+	if _, err := tree.GetNthLeaf(-1); err == nil {
+		t.Fail()
+	}
+	if v, err := tree.MinValue(); err != nil || v != 0 {
+		t.Fail()
+	}
+	if v, err := tree.MaxValue(); err != nil || v != 198 {
+		t.Fail()
+	}
+}
+
+func TestFindInterpolated(t *testing.T) {
+	tree := New()
+
+	for i := 0; i < 1000; i++ {
+		tree.Insert(Element{i})
+	}
+	// Skewed values to trigger the fallback.
+	for i := 1; i < 20; i++ {
+		tree.Insert(Element{i * 100000})
+	}
+
+	for i := 0; i < 1000; i += 7 {
+		if l, err := tree.FindInterpolated(Element{i}); err != nil || tree.GetValue(l).(Element).E != i {
+			t.Fail()
+		}
+	}
+	if l, err := tree.FindInterpolated(Element{500000}); err != nil || tree.GetValue(l).(Element).E != 500000 {
+		t.Fail()
+	}
+	if _, err := tree.FindInterpolated(Element{1500}); err == nil {
+		t.Fail()
+	}
+	if _, err := tree.FindInterpolated(Element{-1}); err == nil {
+		t.Fail()
+	}
+	if tree.leafOrder == nil {
+		t.Fail()
+	}
+
+	// Every modification drops the sorted leaves.
+	tree.Delete(Element{500})
+	if tree.leafOrder != nil {
+		t.Fail()
+	}
+	for i := 0; i < 1000; i += 3 {
+		if _, err := tree.FindInterpolated(Element{i}); (err == nil) != (i != 500) {
+			t.Fail()
+		}
+	}
+
+	// A frozen tree is only read.
+	tree.Insert(Element{500})
+	tree.Freeze()
+	for i := 0; i < 1000; i++ {
+		if l, err := tree.FindInterpolated(Element{i}); err != nil || tree.GetValue(l).(Element).E != i {
+			t.Fail()
+		}
+	}
+	if tree.leafOrder != nil || tree.leafOrderMisses != 0 {
+		t.Fail()
+	}
+}
+
+func benchmarkFindUniform(b *testing.B, find func(*Tree23, TreeElement) (TreeNodeIndex, error)) {
+	maxN := 10000
+	tree := NewCapacity(2 * maxN)
+	for i := 0; i < maxN; i++ {
+		tree.Insert(Element{i})
+	}
+	r := rand.New(rand.NewSource(1))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		find(tree, Element{r.Intn(maxN)})
+	}
+}
+
+func BenchmarkFind(b *testing.B) {
+	benchmarkFindUniform(b, (*Tree23).Find)
+}
+
+func BenchmarkFindInterpolated(b *testing.B) {
+	benchmarkFindUniform(b, (*Tree23).FindInterpolated)
+}
+
+func TestSnapshot(t *testing.T) {
+	tree := New()
+
+	for i := 0; i < 1000; i++ {
+		tree.Insert(Element{i})
+	}
+
+	snapshot := tree.Snapshot()
+	for i := 0; i < 1000; i += 2 {
+		tree.Delete(Element{i})
+	}
+	tree.Insert(Element{5000})
+
+	if snapshot.Len() != 1000 || !snapshot.Invariant() || !tree.Invariant() {
+		t.Fail()
+	}
+	for i := 0; i < 1000; i++ {
+		if _, err := snapshot.Find(Element{i}); err != nil {
+			t.Fail()
+		}
+	}
+	if _, err := snapshot.Find(Element{5000}); err == nil {
+		t.Fail()
+	}
+
+	// The snapshot is a standalone tree.
+	snapshot.Insert(Element{-5})
+	if _, err := tree.Find(Element{-5}); err == nil || !snapshot.Invariant() {
+		t.Fail()
+	}
+}
+
+func TestJournal(t *testing.T) {
+	tree := New()
+	var journal bytes.Buffer
+	tree.SetJournal(&journal)
+
+	for i := 0; i < 1000; i++ {
+		tree.Insert(Element{i})
+	}
+	for i := 0; i < 1000; i += 3 {
+		tree.Delete(Element{i})
+	}
+	if tree.JournalErr() != nil {
+		t.Fail()
+	}
+
+	replayed, err := Replay(bytes.NewReader(journal.Bytes()), makeElement)
+	if err != nil || replayed.Len() != tree.Len() || !replayed.Invariant() {
+		t.Fail()
+	}
+	for i := 0; i < 1000; i++ {
+		_, err1 := tree.Find(Element{i})
+		_, err2 := replayed.Find(Element{i})
+		if (err1 == nil) != (err2 == nil) {
+			t.Fail()
+		}
+	}
+
+	// Incomplete last record.
+	if _, err := Replay(bytes.NewReader(journal.Bytes()[:journal.Len()-1]), makeElement); err == nil {
+		t.Fail()
+	}
+	if _, err := Replay(bytes.NewReader([]byte{'X', 0}), makeElement); err == nil {
+		t.Fail()
+	}
+	if _, err := Replay(bytes.NewReader([]byte{'M', 1, 9}), makeElement); err == nil {
+		t.Fail()
+	}
+}
+
+func TestJournalMode(t *testing.T) {
+	set := NewDescending()
+	set.unique = true
+	var journal bytes.Buffer
+	set.SetJournal(&journal)
+	for i := 0; i < 100; i++ {
+		set.Insert(Element{i % 10})
+	}
+
+	replayed, err := Replay(bytes.NewReader(journal.Bytes()), makeElement)
+	if err != nil || replayed.Len() != 10 || !replayed.Invariant() || !replayed.EqualsSlice(set.ToSlice()) {
+		t.Fail()
+	}
+	if replayed.Insert(Element{3}); replayed.Len() != 10 {
+		t.Fail()
+	}
+	if s := replayed.ToSlice(); !s[0].Equal(Element{9}) {
+		t.Fail()
+	}
+
+	// CopyFrom records the new mode after removing all elements.
+	tree := New()
+	journal.Reset()
+	tree.SetJournal(&journal)
+	tree.Insert(Element{1})
+	tree.CopyFrom(set)
+	tree.Insert(Element{20})
+	replayed, err = Replay(bytes.NewReader(journal.Bytes()), makeElement)
+	if err != nil || !replayed.EqualsSlice(tree.ToSlice()) || !replayed.descending || !replayed.unique {
+		t.Fail()
+	}
+
+	// The mode can not change while the tree has elements.
+	journal.Reset()
+	tree = New()
+	tree.SetJournal(&journal)
+	tree.Insert(Element{1})
+	tree.descending = true
+	tree.SetJournal(&journal)
+	if _, err := Replay(bytes.NewReader(journal.Bytes()), makeElement); err == nil {
+		t.Fail()
+	}
+}
+
+func TestHooks(t *testing.T) {
+	tree := New()
+
+	inserted, deleted := 0, 0
+	tree.SetHooks(func(e TreeElement) { inserted++ }, func(e TreeElement) { deleted++ })
+
+	tree.Insert(Element{1})
+	tree.Delete(Element{2})
+	tree.Delete(Element{1})
+	tree.Delete(Element{1})
+	if inserted != 1 || deleted != 1 {
+		t.Fail()
+	}
+
+	for i := 0; i < 100; i++ {
+		tree.Insert(Element{i})
+		tree.Insert(Element{i})
+	}
+	tree.Delete(Element{500})
+	tree.Delete(Element{-5})
+	tree.Delete(Element{50})
+	if inserted != 201 || deleted != 2 || tree.Len() != 199 || !tree.Invariant() {
+		t.Fail()
+	}
+}
+
+func TestBracket(t *testing.T) {
+	tree := New()
+
+	if _, _, err := tree.Bracket(1); err == nil {
+		t.Fail()
+	}
+
+	for i := 0; i <= 20; i++ {
+		tree.Insert(Element{i * 2})
+	}
+
+	if b, a, err := tree.Bracket(7); err != nil || tree.GetValue(b).(Element).E != 6 || tree.GetValue(a).(Element).E != 8 {
+		t.Fail()
+	}
+	if b, a, err := tree.Bracket(8); err != nil || b != a || tree.GetValue(a).(Element).E != 8 {
+		t.Fail()
+	}
+	if b, a, err := tree.Bracket(-1); err != nil || b != -1 || tree.GetValue(a).(Element).E != 0 {
+		t.Fail()
+	}
+	if b, a, err := tree.Bracket(41); err != nil || a != -1 || tree.GetValue(b).(Element).E != 40 {
+		t.Fail()
+	}
+}
+
+func TestWriteCSV(t *testing.T) {
+	tree := New()
+
+	for i := 3; i >= 0; i-- {
+		tree.Insert(Element{i})
+	}
+
+	var b bytes.Buffer
+	err := tree.WriteCSV(&b, func(e TreeElement) []string {
+		return []string{strconv.Itoa(e.(Element).E), "x"}
+	})
+	if err != nil || b.String() != "0,x\n1,x\n2,x\n3,x\n" {
+		t.Fail()
+	}
+
+	b.Reset()
+	if err := New().WriteCSV(&b, nil); err != nil || b.Len() != 0 {
+		t.Fail()
+	}
+}
+
+func TestRepairLeafList(t *testing.T) {
+	tree := New()
+
+	if tree.RepairLeafList() || !tree.CheckLeafList() {
+		t.Fail()
+	}
+
+	for i := 0; i < 100; i++ {
+		tree.Insert(Element{i})
+	}
+	if tree.RepairLeafList() || !tree.CheckLeafList() {
+		t.Fail()
+	}
+
+	l, _ := tree.Find(Element{40})
+	n, _ := tree.Find(Element{70})
+	tree.treeNodes[l].next = n
+	smallest, _ := tree.GetSmallestLeaf()
+	tree.treeNodes[smallest].prev = smallest
+
+	if tree.CheckLeafList() || !tree.RepairLeafList() || !tree.CheckLeafList() || !tree.Invariant() {
+		t.Fail()
+	}
+}
+
+func TestInsertWithHint(t *testing.T) {
+	tree := New()
+
+	hint := TreeNodeIndex(-1)
+	for i := 0; i < 1000; i++ {
+		hint = tree.InsertWithHint(hint, Element{i})
+		if tree.GetValue(hint).(Element).E != i {
+			t.Fail()
+		}
+	}
+	// Hints that don't fit.
+	l := tree.InsertWithHint(hint, Element{-5})
+	l = tree.InsertWithHint(l, Element{500})
+	tree.InsertWithHint(12345, Element{501})
+
+	if tree.Len() != 1003 || !tree.Invariant() || tree.GetValue(l).(Element).E != 500 {
+		t.Fail()
+	}
+	for i := 0; i < 1000; i++ {
+		if _, err := tree.Find(Element{i}); err != nil {
+			t.Fail()
+		}
+	}
+
+	// Hints in the middle of the tree.
+	values := New()
+	values.SetInvariantChecks(true)
+	for i := 0; i < 100; i++ {
+		values.Insert(ValueElement{i * 10, 0})
+	}
+	hint, _ = values.Find(ValueElement{500, 0})
+	for i := 1; i < 10; i++ {
+		hint = values.InsertWithHint(hint, ValueElement{500 + i, i})
+		if values.GetValue(values.treeNodes[hint].prev).(ValueElement).V != 500+i-1 {
+			t.Fail()
+		}
+	}
+	// Equal values only fit behind an equal element.
+	hint, _ = values.Find(ValueElement{300, 0})
+	if l := values.InsertWithHint(hint, ValueElement{300, 0}); values.treeNodes[l].prev != hint {
+		t.Fail()
+	}
+	l = values.InsertWithHint(hint, ValueElement{300, 1})
+	if n := values.GetValue(values.treeNodes[l].next).(ValueElement); n.V != 310 {
+		t.Fail()
+	}
+	// A value larger than the next leaf falls back to Insert.
+	l = values.InsertWithHint(hint, ValueElement{705, 0})
+	if values.GetValue(values.treeNodes[l].prev).(ValueElement).V != 700 {
+		t.Fail()
+	}
+	if values.Len() != 112 || !values.Invariant() || !checkContiguous(values) {
+		t.Fail()
+	}
+	if ok, _ := values.CheckOrdering(); !ok {
+		t.Fail()
+	}
+
+	desc := NewDescending()
+	for i := 0; i < 100; i++ {
+		desc.Insert(Element{i * 2})
+	}
+	hint, _ = desc.Find(Element{50})
+	if l := desc.InsertWithHint(hint, Element{49}); desc.treeNodes[l].prev != hint || !desc.Invariant() {
+		t.Fail()
+	}
+}
+
+func BenchmarkInsertSequential(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		tree := NewCapacity(200000)
+		for j := 0; j < 100000; j++ {
+			tree.Insert(Element{j})
+		}
+	}
+}
+
+func BenchmarkInsertSequentialWithHint(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		tree := NewCapacity(200000)
+		hint := TreeNodeIndex(-1)
+		for j := 0; j < 100000; j++ {
+			hint = tree.InsertWithHint(hint, Element{j})
+		}
+	}
+}
+
+func TestInsertMonotonic(t *testing.T) {
+	tree := New()
+	tree.SetInvariantChecks(true)
+	for i := 0; i < 1000; i++ {
+		tree.InsertMonotonic(ValueElement{i / 3, i % 2})
+	}
+	// Elements that break the order.
+	tree.InsertMonotonic(ValueElement{10, 5})
+	tree.InsertMonotonic(ValueElement{-1, 5})
+	tree.InsertMonotonic(ValueElement{333, 1})
+
+	if tree.Len() != 1003 || tree.CountEqual(ValueElement{333, 1}) != 2 || tree.CountEqual(ValueElement{10, 5}) != 1 {
+		t.Fail()
+	}
+	if l, _ := tree.GetSmallestLeaf(); !tree.GetValue(l).Equal(ValueElement{-1, 5}) {
+		t.Fail()
+	}
+	if ok, _ := tree.CheckOrdering(); !ok {
+		t.Fail()
+	}
+
+	set := NewSet()
+	set.InsertMonotonic(Element{1})
+	set.InsertMonotonic(Element{1})
+	if set.Len() != 1 {
+		t.Fail()
+	}
+}
+
+func BenchmarkInsertSequentialMonotonic(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		tree := NewCapacity(200000)
+		for j := 0; j < 100000; j++ {
+			tree.InsertMonotonic(Element{j})
+		}
+	}
+}
+
+// ValueElement is only equal to other elements with the same value and id.
+type ValueElement struct {
+	V  int
+	ID int
+}
+
+func (e ValueElement) Equal(e2 TreeElement) bool {
+	return e == e2.(ValueElement)
+}
+func (e ValueElement) ExtractValue() float64 {
+	return float64(e.V)
+}
+
+func TestDeleteNode(t *testing.T) {
+	tree := New()
+
+	if err := tree.DeleteNode(0); err == nil {
+		t.Fail()
+	}
+
+	for i := 0; i < 300; i++ {
+		tree.Insert(ValueElement{i % 10, i})
+	}
+
+	// Delete every leaf with a value of 5 directly.
+	l, _ := tree.FindFirstLargerLeaf(5)
+	for tree.GetValue(l).ExtractValue() == 5 {
+		next, _ := tree.Next(l)
+		if err := tree.DeleteNode(l); err != nil {
+			t.Fail()
+		}
+		if err := tree.DeleteNode(l); err == nil {
+			t.Fail()
+		}
+		l = next
+	}
+
+	if tree.Len() != 270 || !tree.Invariant() {
+		t.Fail()
+	}
+	if l, err := tree.FindFirstLargerLeaf(5); err != nil || tree.GetValue(l).ExtractValue() != 6 {
+		t.Fail()
+	}
+
+	// Internal nodes can not be deleted.
+	if err := tree.DeleteNode(tree.root); err == nil {
+		t.Fail()
+	}
+	for tree.Len() > 0 {
+		l, _ := tree.GetLargestLeaf()
+		if err := tree.DeleteNode(l); err != nil {
+			t.Fail()
+			break
+		}
+	}
+	if !tree.Invariant() {
+		t.Fail()
+	}
+}
+
+func TestDescending(t *testing.T) {
+	tree := NewDescending()
+
+	r := rand.New(rand.NewSource(1))
+	for _, i := range r.Perm(100) {
+		tree.Insert(Element{i})
+	}
+	if !tree.Invariant() {
+		t.Fail()
+	}
+
+	if l, err := tree.GetSmallestLeaf(); err != nil || tree.GetValue(l).(Element).E != 99 {
+		t.Fail()
+	}
+	if l, err := tree.GetLargestLeaf(); err != nil || tree.GetValue(l).(Element).E != 0 {
+		t.Fail()
+	}
+	if l, err := tree.GetNthLeaf(10); err != nil || tree.GetValue(l).(Element).E != 89 {
+		t.Fail()
+	}
+	l, _ := tree.Find(Element{40})
+	if n, _ := tree.Next(l); tree.GetValue(n).(Element).E != 39 {
+		t.Fail()
+	}
+	if l, err := tree.FindFirstLargerLeaf(50.5); err != nil || tree.GetValue(l).(Element).E != 50 {
+		t.Fail()
+	}
+	if b, a, err := tree.Bracket(50.5); err != nil || tree.GetValue(b).(Element).E != 51 || tree.GetValue(a).(Element).E != 50 {
+		t.Fail()
+	}
+	if l, err := tree.FindInterpolated(Element{3}); err != nil || tree.GetValue(l).(Element).E != 3 {
+		t.Fail()
+	}
+	if h := tree.Histogram(0, 10, 2); len(h) != 2 || h[0] != 5 || h[1] != 6 {
+		t.Fail()
+	}
+
+	for i := 0; i < 100; i += 2 {
+		tree.Delete(Element{i})
+	}
+	if tree.Len() != 50 || !tree.Invariant() {
+		t.Fail()
+	}
+}
+
+func TestFindBatch(t *testing.T) {
+	tree := New()
+
+	for i := 0; i < 1000; i += 2 {
+		tree.Insert(Element{i})
+	}
+
+	// Small batch with repeated lookups and large batch with the sorted walk.
+	for _, n := range []int{10, 1000} {
+		elems := make([]TreeElement, n)
+		for i := range elems {
+			elems[i] = Element{(i * 7919) % 1100}
+		}
+		result := tree.FindBatch(elems)
+		for i, l := range result {
+			e := elems[i].(Element).E
+			if (e%2 == 0 && e < 1000) != (l != -1) || (l != -1 && tree.GetValue(l).(Element).E != e) {
+				t.Fail()
+			}
+		}
+	}
+
+	if r := New().FindBatch([]TreeElement{Element{1}}); len(r) != 1 || r[0] != -1 {
+		t.Fail()
+	}
+}
+
+func TestMarshalText(t *testing.T) {
+	tree := New()
+
+	for i := 0; i < 100; i++ {
+		tree.Insert(Element{(i * 37) % 100})
+	}
+	tree.Insert(Element{-3})
+
+	text, err := tree.MarshalText()
+	if err != nil || !bytes.HasPrefix(text, []byte("-3\n0\n1\n")) {
+		t.Fail()
+	}
+
+	other := New()
+	if err := other.UnmarshalText(text); err == nil {
+		t.Fail()
+	}
+	other.SetTextFormat(nil, func(v float64) TreeElement { return Element{int(v)} })
+	other.Insert(Element{1000})
+	if err := other.UnmarshalText(text); err != nil || other.Len() != 101 || !other.Invariant() {
+		t.Fail()
+	}
+	if text2, err := other.MarshalText(); err != nil || !bytes.Equal(text, text2) {
+		t.Fail()
+	}
+	if err := other.UnmarshalText([]byte("1\nx\n")); err == nil || other.Len() != 101 {
+		t.Fail()
+	}
+
+	other.SetTextFormat(func(e TreeElement) string { return fmt.Sprintf("%v", e) }, nil)
+	if text, err := other.MarshalText(); err != nil || !bytes.HasPrefix(text, []byte("{-3}\n{0}\n")) {
+		t.Fail()
+	}
+
+	// A custom format round trips with a matching parser.
+	values := New()
+	for i := 0; i < 50; i++ {
+		values.Insert(ValueElement{i % 7, i})
+	}
+	values.SetTextFormat(func(e TreeElement) string {
+		v := e.(ValueElement)
+		return fmt.Sprintf("%d id=%d", v.V, v.ID)
+	}, nil)
+	text, err = values.MarshalText()
+	if err != nil {
+		t.Fail()
+	}
+	parsed := New()
+	parsed.SetTextFormat(values.textFormat, nil)
+	if err := parsed.UnmarshalText(text); err == nil {
+		t.Fail()
+	}
+	parsed.SetTextParser(func(line string) (TreeElement, error) {
+		var v ValueElement
+		_, err := fmt.Sscanf(line, "%d id=%d", &v.V, &v.ID)
+		return v, err
+	})
+	if err := parsed.UnmarshalText(text); err != nil || !parsed.EqualsSlice(values.ToSlice()) || !parsed.Invariant() {
+		t.Fail()
+	}
+	if text2, err := parsed.MarshalText(); err != nil || !bytes.Equal(text, text2) {
+		t.Fail()
+	}
+	if err := parsed.UnmarshalText([]byte("1 id=x\n")); err == nil || parsed.Len() != 50 {
+		t.Fail()
+	}
+
+	values.SetTextFormat(func(e TreeElement) string { return "a\nb" }, nil)
+	if _, err := values.MarshalText(); err == nil {
+		t.Fail()
+	}
+}
+
+// checkContiguous returns true, if all equal elements are next to each other in the leaf list.
+func checkContiguous(tree *Tree23) bool {
+	seen := make(map[TreeElement]bool)
+	l, _ := tree.GetSmallestLeaf()
+	var last TreeElement
+	for i := 0; i < tree.Len(); i++ {
+		e := tree.GetValue(l)
+		if last == nil || !last.Equal(e) {
+			if seen[e] {
+				return false
+			}
+			seen[e] = true
+		}
+		last = e
+		l, _ = tree.Next(l)
+	}
+	return true
+}
+
+func TestDuplicatesContiguous(t *testing.T) {
+	tree := New()
+
+	var seed int64 = time.Now().UTC().UnixNano()
+	defer func() {
+		if t.Failed() {
+			t.Logf("Seed: %v", seed)
+		}
+	}()
+	r := rand.New(rand.NewSource(seed))
+
+	counts := make(map[ValueElement]int)
+	for i := 0; i < 3000; i++ {
+		e := ValueElement{r.Intn(10), r.Intn(8)}
+		tree.Insert(e)
+		counts[e]++
+	}
+	if !tree.Invariant() || !checkContiguous(tree) {
+		t.Fail()
+	}
+	// Each element is inserted once at its final position, nothing is deleted again.
+	if _, merges := tree.StructuralOps(); merges != 0 {
+		t.Fail()
+	}
+	for e, c := range counts {
+		if l, err := tree.Find(e); err != nil || tree.GetValue(l) != e || tree.CountEqual(e) != c {
+			t.Fail()
+		}
+	}
+
+	// Delete has to find all equal elements, even if they are not in the first subtree with their value.
+	for e, c := range counts {
+		for i := 0; i < c; i++ {
+			tree.Delete(e)
+		}
+		if _, err := tree.Find(e); err == nil || tree.CountEqual(e) != 0 {
+			t.Fail()
+		}
+	}
+	if tree.Len() != 0 || !tree.Invariant() {
+		t.Fail()
+	}
+}
+
+func TestScanFrom(t *testing.T) {
+	tree := New()
+
+	for i := 0; i < 100; i++ {
+		tree.Insert(Element{i})
+	}
+
+	var got []int
+	collect := func(e TreeElement) bool {
+		got = append(got, e.(Element).E)
+		return true
+	}
+
+	tree.ScanFrom(10.5, 3, collect)
+	if len(got) != 3 || got[0] != 11 || got[2] != 13 {
+		t.Fail()
+	}
+	got = nil
+	tree.ScanFrom(97, 10, collect)
+	if len(got) != 3 || got[2] != 99 {
+		t.Fail()
+	}
+	got = nil
+	tree.ScanFrom(100, 10, collect)
+	tree.ScanFrom(0, 0, collect)
+	if len(got) != 0 {
+		t.Fail()
+	}
+	tree.ScanFrom(-5, 10, func(e TreeElement) bool {
+		got = append(got, e.(Element).E)
+		return e.(Element).E < 4
+	})
+	if len(got) != 5 || got[0] != 0 {
+		t.Fail()
+	}
+}
+
+func TestTrimFreeList(t *testing.T) {
+	tree := New()
+
+	for i := 0; i < 10000; i++ {
+		tree.Insert(Element{i})
+	}
+	for i := 0; i < 10000; i++ {
+		tree.Delete(Element{i})
+	}
+	// Reuse most of the recycled nodes again.
+	for i := 0; i < 9000; i++ {
+		tree.Insert(Element{i})
+	}
+	l, _ := tree.Find(Element{50})
+
+	free := len(tree.treeNodesFreePositions)
+	tree.TrimFreeList()
+	if cap(tree.treeNodesFreePositions) != free || !tree.Invariant() || tree.GetValue(l).(Element).E != 50 {
+		t.Fail()
+	}
+	for i := 9000; i < 10000; i++ {
+		tree.Insert(Element{i})
+	}
+	if tree.Len() != 10000 || !tree.Invariant() {
+		t.Fail()
+	}
+}
+
+func TestAllocStats(t *testing.T) {
+	tree := New()
+
+	for i := 0; i < 1000; i++ {
+		tree.Insert(Element{i})
+	}
+	fromCache, fresh, recycled := tree.AllocStats()
+	if fresh == 0 || int(fresh) != tree.treeNodesFirstFreePos-1 {
+		t.Fail()
+	}
+
+	for i := 0; i < 1000; i++ {
+		tree.Delete(Element{i})
+		tree.Insert(Element{i})
+	}
+	fromCache2, fresh2, recycled2 := tree.AllocStats()
+	if fromCache2 <= fromCache || recycled2 <= recycled || fresh2 < fresh {
+		t.Fail()
+	}
+	// Every recycled node is either reused or still on the stack.
+	if recycled2-fromCache2 != int64(len(tree.treeNodesFreePositions)) {
+		t.Fail()
+	}
+}
+
+// panics returns true, if f panics.
+func panics(f func()) (p bool) {
+	defer func() {
+		p = recover() != nil
+	}()
+	f()
+	return false
+}
+
+func TestFreeze(t *testing.T) {
+	tree := New()
+
+	for i := 0; i < 100; i++ {
+		tree.Insert(Element{i})
+	}
+	tree.Freeze()
+
+	l, _ := tree.Find(Element{5})
+	if !tree.IsFrozen() ||
+		!panics(func() { tree.Insert(Element{5}) }) ||
+		!panics(func() { tree.Delete(Element{5}) }) ||
+		!panics(func() { tree.DeleteNode(l) }) ||
+		!panics(func() { tree.ChangeValue(l, Element{5}) }) ||
+		!panics(func() { tree.ChangeValueUnsafe(l, Element{5}) }) {
+		t.Fail()
+	}
+	if _, err := tree.Find(Element{5}); err != nil || tree.Len() != 100 || !tree.Invariant() {
+		t.Fail()
+	}
+	if clone := tree.Clone(); clone.IsFrozen() || panics(func() { clone.Insert(Element{5}) }) {
+		t.Fail()
+	}
+
+	tree.Thaw()
+	tree.Delete(Element{5})
+	if tree.IsFrozen() || tree.Len() != 99 {
+		t.Fail()
+	}
+}
+
+func TestInsertFromChannel(t *testing.T) {
+	tree := New()
+
+	ch := make(chan TreeElement)
+	go func() {
+		for i := 0; i < 100; i++ {
+			ch <- Element{i}
+		}
+		close(ch)
+	}()
+	tree.InsertFromChannel(ch, nil)
+	if tree.Len() != 100 || !tree.Invariant() {
+		t.Fail()
+	}
+
+	// Stop on done, while the channel stays open.
+	ch = make(chan TreeElement)
+	done := make(chan struct{})
+	go func() {
+		for i := 100; i < 110; i++ {
+			ch <- Element{i}
+		}
+		close(done)
+	}()
+	tree.InsertFromChannel(ch, done)
+	if tree.Len() != 110 || !tree.Invariant() {
+		t.Fail()
+	}
+}
+
+func TestToSlice(t *testing.T) {
+	tree := New()
+
+	if s := tree.ToSlice(); s == nil || len(s) != 0 {
+		t.Fail()
+	}
+	if s := tree.ToSliceDescending(); s == nil || len(s) != 0 {
+		t.Fail()
+	}
+
+	tree.Insert(Element{7})
+	if s := tree.ToSliceDescending(); len(s) != 1 || !s[0].Equal(Element{7}) {
+		t.Fail()
+	}
+
+	for _, v := range rand.Perm(100) {
+		tree.Insert(Element{v})
+	}
+	tree.Delete(Element{7})
+
+	asc := tree.ToSlice()
+	desc := tree.ToSliceDescending()
+	if len(asc) != 100 || len(desc) != 100 {
+		t.Fail()
+	}
+	for i := range asc {
+		if !asc[i].Equal(Element{i}) || !desc[i].Equal(Element{99 - i}) {
+			t.Fail()
+		}
+	}
+}
+
+func TestSet(t *testing.T) {
+	tree := NewSet()
+
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 100; j++ {
+			tree.Insert(Element{j})
+		}
+	}
+	if tree.Len() != 100 || !tree.Invariant() {
+		t.Fail()
+	}
+
+	if tree.InsertUnique(Element{50}) {
+		t.Fail()
+	}
+	if !tree.InsertUnique(Element{100}) || tree.Len() != 101 {
+		t.Fail()
+	}
+
+	l, _ := tree.Find(Element{10})
+	if tree.InsertWithHint(l, Element{10}) != l || tree.Len() != 101 {
+		t.Fail()
+	}
+
+	// Equal values, but not equal elements are still stored both.
+	set := NewSet()
+	set.Insert(ValueElement{1, 1})
+	set.Insert(ValueElement{1, 2})
+	set.Insert(ValueElement{1, 1})
+	if set.Len() != 2 {
+		t.Fail()
+	}
+
+	// InsertUnique works on normal trees as well.
+	multi := New()
+	multi.Insert(Element{1})
+	multi.Insert(Element{1})
+	if multi.InsertUnique(Element{1}) || multi.Len() != 2 {
+		t.Fail()
+	}
+}
+
+func TestDeleteSlice(t *testing.T) {
+	tree := New()
+
+	if tree.DeleteSlice([]TreeElement{Element{1}}) != 0 {
+		t.Fail()
+	}
+
+	for i := 0; i < 1000; i++ {
+		tree.Insert(Element{i})
+		tree.Insert(Element{i})
+	}
+
+	// Few elements are deleted one by one, like with Delete.
+	m := &countingMetrics{}
+	tree.SetMetrics(m)
+	if tree.DeleteSlice([]TreeElement{Element{-1}, Element{5}, Element{5}, Element{5}, Element{2000}}) != 2 {
+		t.Fail()
+	}
+	if tree.Len() != 1998 || tree.CountEqual(Element{5}) != 0 || !tree.Invariant() || m.deletes != 5 || tree.Undo() {
+		t.Fail()
+	}
+	tree.SetMetrics(nil)
+
+	// Delete every even element once and a few that do not exist.
+	var elems []TreeElement
+	for i := -10; i < 1010; i += 2 {
+		elems = append(elems, Element{i})
+	}
+	if n := tree.DeleteSlice(elems); n != 500 {
+		t.Fail()
+	}
+	if tree.Len() != 1498 || !tree.Invariant() {
+		t.Fail()
+	}
+	for i := 0; i < 1000; i++ {
+		want := 2
+		if i == 5 {
+			want = 0
+		} else if i%2 == 0 {
+			want = 1
+		}
+		if tree.CountEqual(Element{i}) != want {
+			t.Fail()
+		}
+	}
+
+	// Delete everything.
+	all := tree.ToSlice()
+	if tree.DeleteSlice(all) != 1498 || tree.Len() != 0 || !tree.Invariant() {
+		t.Fail()
+	}
+	tree.Insert(Element{1})
+	if tree.Len() != 1 || !tree.Invariant() {
+		t.Fail()
+	}
+}
+
+func BenchmarkDeleteSlice(b *testing.B) {
+	maxN := 100000
+	tree := NewCapacity(2 * maxN)
+	var elems []TreeElement
+	for i := 0; i < maxN; i++ {
+		tree.Insert(Element{i})
+		if i%2 == 0 {
+			elems = append(elems, Element{i})
+		}
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tree.Clone().DeleteSlice(elems)
+	}
+}
+
+func BenchmarkDeleteSliceByDelete(b *testing.B) {
+	maxN := 100000
+	tree := NewCapacity(2 * maxN)
+	var elems []TreeElement
+	for i := 0; i < maxN; i++ {
+		tree.Insert(Element{i})
+		if i%2 == 0 {
+			elems = append(elems, Element{i})
+		}
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c := tree.Clone()
+		for _, e := range elems {
+			c.Delete(e)
+		}
+	}
+}
+
+func TestAnyAllInRange(t *testing.T) {
+	tree := New()
+	for i := 0; i < 100; i++ {
+		tree.Insert(Element{i})
+	}
+
+	even := func(e TreeElement) bool { return e.(Element).E%2 == 0 }
+	small := func(e TreeElement) bool { return e.(Element).E < 50 }
+
+	if !tree.AnyInRange(10, 20, even) || tree.AnyInRange(11, 11, even) || !tree.AnyInRange(9.5, 10.5, even) {
+		t.Fail()
+	}
+	if !tree.AllInRange(0, 49, small) || tree.AllInRange(0, 50, small) || tree.AllInRange(10, 12, even) {
+		t.Fail()
+	}
+
+	// Stops at the first match/non-match.
+	calls := 0
+	tree.AnyInRange(0, 99, func(e TreeElement) bool { calls++; return e.(Element).E == 3 })
+	if calls != 4 {
+		t.Fail()
+	}
+	calls = 0
+	tree.AllInRange(0, 99, func(e TreeElement) bool { calls++; return e.(Element).E < 3 })
+	if calls != 4 {
+		t.Fail()
+	}
+
+	// Empty ranges.
+	if tree.AnyInRange(200, 300, small) || !tree.AllInRange(200, 300, even) {
+		t.Fail()
+	}
+	if tree.AnyInRange(20, 10, small) || !tree.AllInRange(10.2, 10.8, even) {
+		t.Fail()
+	}
+	if New().AnyInRange(0, 1, small) || !New().AllInRange(0, 1, small) {
+		t.Fail()
+	}
+
+	desc := NewDescending()
+	for i := 0; i < 100; i++ {
+		desc.Insert(Element{i})
+	}
+	if !desc.AllInRange(0, 49, small) || desc.AllInRange(0, 50, small) || desc.AnyInRange(20, 10, small) {
+		t.Fail()
+	}
+}
+
+func TestWalk(t *testing.T) {
+	tree := New()
+
+	New().Walk(func(level int, isLeaf bool, idx TreeNodeIndex, maxChild float64) {
+		t.Fail()
+	})
+
+	for i := 0; i < 100; i++ {
+		tree.Insert(Element{i})
+	}
+
+	// Depths counts the leaf level as well.
+	depth, _ := tree.Depths()
+	leaves := 0
+	var last float64 = -1
+	tree.Walk(func(level int, isLeaf bool, idx TreeNodeIndex, maxChild float64) {
+		if level == 0 && (idx != tree.root || maxChild != 99) {
+			t.Fail()
+		}
+		if tree.IsLeaf(idx) != isLeaf {
+			t.Fail()
+		}
+		if isLeaf {
+			// Pre-order visits the leaves in sorted order.
+			if level != depth-1 || maxChild != tree.GetValue(idx).ExtractValue() || maxChild <= last {
+				t.Fail()
+			}
+			last = maxChild
+			leaves++
+		}
+	})
+	if leaves != 100 {
+		t.Fail()
+	}
+}
+
+func TestCursorRemove(t *testing.T) {
+	tree := New()
+
+	if c := tree.NewCursor(); c.Valid() || c.Value() != nil || c.Remove() == nil {
+		t.Fail()
+	}
+
+	for i := 0; i < 1000; i++ {
+		tree.Insert(Element{i})
+	}
+
+	// Remove all odd elements while iterating.
+	visited := 0
+	for c := tree.NewCursor(); c.Valid(); {
+		visited++
+		if c.Value().(Element).E%2 == 1 {
+			if c.Remove() != nil {
+				t.Fail()
+			}
+			continue
+		}
+		c.Next()
+	}
+	if visited != 1000 || tree.Len() != 500 || !tree.Invariant() {
+		t.Fail()
+	}
+	for i, e := range tree.ToSlice() {
+		if !e.Equal(Element{2 * i}) {
+			t.Fail()
+		}
+	}
+
+	// Remove everything, including the last leaf.
+	c := tree.NewCursor()
+	for c.Valid() {
+		c.Remove()
+	}
+	if tree.Len() != 0 || c.Leaf() != -1 || !tree.Invariant() {
+		t.Fail()
+	}
+}
+
+func TestMemoryReport(t *testing.T) {
+	tree := New()
+
+	if r, f, a := tree.MemoryReport(); r != 1 || f != 0 || a != 1 {
+		t.Fail()
+	}
+
+	for i := 0; i < 1000; i++ {
+		tree.Insert(Element{i})
+	}
+	r, f, a := tree.MemoryReport()
+	if r+f != a || r < 1000 {
+		t.Fail()
+	}
+
+	for i := 0; i < 900; i++ {
+		tree.Delete(Element{i})
+	}
+	r2, f2, a2 := tree.MemoryReport()
+	if r2+f2 != a2 || a2 != a || f2 <= f || r2 >= r {
+		t.Fail()
+	}
+}
+
+func TestFindApprox(t *testing.T) {
+	tree := New()
+
+	if _, err := tree.FindApprox(1, 1); err == nil {
+		t.Fail()
+	}
+
+	for i := 0; i < 10; i++ {
+		tree.Insert(Element{i * 10})
+	}
+
+	value := func(l TreeNodeIndex) int { return tree.GetValue(l).(Element).E }
+
+	if l, err := tree.FindApprox(0.1+0.2, 0.5); err != nil || value(l) != 0 {
+		t.Fail()
+	}
+	if l, err := tree.FindApprox(23, 5); err != nil || value(l) != 20 {
+		t.Fail()
+	}
+	if l, err := tree.FindApprox(27, 5); err != nil || value(l) != 30 {
+		t.Fail()
+	}
+	// Equal distance returns the smaller leaf.
+	if l, err := tree.FindApprox(25, 5); err != nil || value(l) != 20 {
+		t.Fail()
+	}
+	if l, err := tree.FindApprox(-3, 5); err != nil || value(l) != 0 {
+		t.Fail()
+	}
+	if l, err := tree.FindApprox(93, 5); err != nil || value(l) != 90 {
+		t.Fail()
+	}
+	if _, err := tree.FindApprox(25, 4.9); err == nil {
+		t.Fail()
+	}
+	if _, err := tree.FindApprox(100, 5); err == nil {
+		t.Fail()
+	}
+	if l, err := tree.FindApprox(40, 0); err != nil || value(l) != 40 {
+		t.Fail()
+	}
+
+	// Ties are broken on the value, not on the order of the tree.
+	desc := NewDescending()
+	for i := 0; i < 10; i++ {
+		desc.Insert(Element{i})
+	}
+	if l, err := desc.FindApprox(4.5, 1); err != nil || desc.GetValue(l).(Element).E != 4 {
+		t.Fail()
+	}
+}
+
+func TestAppendValues(t *testing.T) {
+	tree := New()
+
+	buf := make([]TreeElement, 0, 100)
+	if b := tree.AppendValues(buf); len(b) != 0 {
+		t.Fail()
+	}
+
+	for i := 0; i < 100; i++ {
+		tree.Insert(Element{i})
+	}
+
+	for k := 0; k < 3; k++ {
+		buf = tree.AppendValues(buf[:0])
+		if len(buf) != 100 || cap(buf) != 100 {
+			t.Fail()
+		}
+		for i, e := range buf {
+			if !e.Equal(Element{i}) {
+				t.Fail()
+			}
+		}
+	}
+
+	buf = tree.AppendValuesInRange(buf[:0], 9.5, 20)
+	if len(buf) != 11 || !buf[0].Equal(Element{10}) || !buf[10].Equal(Element{20}) {
+		t.Fail()
+	}
+	buf = tree.AppendValuesInRange(buf, 200, 300)
+	if len(buf) != 11 {
+		t.Fail()
+	}
+
+	allocs := testing.AllocsPerRun(10, func() {
+		buf = tree.AppendValues(buf[:0])
+	})
+	if allocs != 0 {
+		t.Fail()
+	}
+}
+
+func TestCheckOrdering(t *testing.T) {
+	tree := New()
+
+	if ok, l := tree.CheckOrdering(); !ok || l != -1 {
+		t.Fail()
+	}
+
+	for i := 0; i < 100; i++ {
+		tree.Insert(Element{i})
+		tree.Insert(Element{i})
+	}
+	if ok, l := tree.CheckOrdering(); !ok || l != -1 {
+		t.Fail()
+	}
+
+	l50, _ := tree.FindFirstLargerLeaf(50)
+	tree.ChangeValueUnsafe(l50, Element{200})
+	next, _ := tree.Next(l50)
+	if ok, l := tree.CheckOrdering(); ok || l != next {
+		t.Fail()
+	}
+	tree.ChangeValueUnsafe(l50, Element{50})
+
+	l20, _ := tree.FindFirstLargerLeaf(20)
+	tree.ChangeValueUnsafe(l20, Element{-1})
+	if ok, l := tree.CheckOrdering(); ok || l != l20 {
+		t.Fail()
+	}
+}
+
+// SlowElement counts the calls of ExtractValue and takes a while to compute the value.
+type SlowElement struct {
+	E     int
+	calls *int
+}
+
+func (e SlowElement) Equal(e2 TreeElement) bool {
+	return e.E == e2.(SlowElement).E
+}
+func (e SlowElement) ExtractValue() float64 {
+	*e.calls++
+	v := float64(e.E)
+	for i := 0; i < 100; i++ {
+		v = v*1.0000001 - v*0.0000001
+	}
+	return float64(e.E)
+}
+
+func TestInsertWithKey(t *testing.T) {
+	tree := New()
+	calls := 0
+
+	for _, v := range rand.Perm(1000) {
+		tree.InsertWithKey(float64(v), SlowElement{v, &calls})
+	}
+	if calls != 0 || tree.Len() != 1000 || !tree.Invariant() {
+		t.Fail()
+	}
+	for i, e := range tree.ToSlice() {
+		if e.(SlowElement).E != i {
+			t.Fail()
+		}
+	}
+
+	// Cached keys are used for searching as well.
+	calls = 0
+	if l, err := tree.FindFirstLargerLeaf(500); err != nil || tree.GetValue(l).(SlowElement).E != 500 || calls != 0 {
+		t.Fail()
+	}
+
+	desc := NewDescending()
+	for i := 0; i < 100; i++ {
+		desc.InsertWithKey(float64(i), Element{i})
+	}
+	if s := desc.ToSlice(); !desc.Invariant() || !s[0].Equal(Element{99}) {
+		t.Fail()
+	}
+}
+
+func BenchmarkInsertSlowExtractValue(b *testing.B) {
+	calls := 0
+	for i := 0; i < b.N; i++ {
+		tree := NewCapacity(10000)
+		for j := 0; j < 5000; j++ {
+			tree.Insert(SlowElement{j, &calls})
+		}
+	}
+}
+
+func BenchmarkInsertWithKeySlowExtractValue(b *testing.B) {
+	calls := 0
+	for i := 0; i < b.N; i++ {
+		tree := NewCapacity(10000)
+		for j := 0; j < 5000; j++ {
+			tree.InsertWithKey(float64(j), SlowElement{j, &calls})
+		}
+	}
+}
+
+func TestFindAtFraction(t *testing.T) {
+	tree := New()
+
+	if _, err := tree.FindAtFraction(0.5); err == nil {
+		t.Fail()
+	}
+
+	// Values are not evenly distributed: 0..9 and 100.
+	for i := 0; i < 10; i++ {
+		tree.Insert(Element{i})
+	}
+	tree.Insert(Element{100})
+
+	value := func(f float64) int {
+		l, err := tree.FindAtFraction(f)
+		if err != nil {
+			return -1
+		}
+		return tree.GetValue(l).(Element).E
+	}
+
+	if value(0) != 0 || value(1) != 100 || value(0.05) != 5 || value(0.5) != 9 || value(0.6) != 100 {
+		t.Fail()
+	}
+	for _, f := range []float64{-0.1, 1.1, math.NaN()} {
+		if _, err := tree.FindAtFraction(f); err == nil {
+			t.Fail()
+		}
+	}
+}
+
+func TestPriorityQueue(t *testing.T) {
+	pq := NewPriorityQueue()
+
+	if _, ok := pq.Pop(); ok {
+		t.Fail()
+	}
+	if _, ok := pq.Peek(); ok {
+		t.Fail()
+	}
+
+	for _, v := range rand.Perm(100) {
+		pq.Push(ValueElement{v, 0})
+	}
+	// Same values are returned in insertion order.
+	pq.Push(ValueElement{50, 1})
+	pq.Push(ValueElement{50, 2})
+
+	for i := 0; i < 50; i++ {
+		if e, ok := pq.Peek(); !ok || e != (ValueElement{i, 0}) {
+			t.Fail()
+		}
+		if e, ok := pq.Pop(); !ok || e != (ValueElement{i, 0}) {
+			t.Fail()
+		}
+	}
+	if e, _ := pq.Pop(); e != (ValueElement{50, 0}) {
+		t.Fail()
+	}
+	if e, _ := pq.Pop(); e != (ValueElement{50, 1}) {
+		t.Fail()
+	}
+	if e, _ := pq.Pop(); e != (ValueElement{50, 2}) {
+		t.Fail()
+	}
+	if pq.Len() != 49 || !pq.Invariant() {
+		t.Fail()
+	}
+
+	maxQueue := PriorityQueue{NewDescending()}
+	maxQueue.Push(Element{1})
+	maxQueue.Push(Element{3})
+	maxQueue.Push(Element{2})
+	if e, _ := maxQueue.Pop(); !e.Equal(Element{3}) {
+		t.Fail()
+	}
+}
+
+func TestContainsAll(t *testing.T) {
+	tree := New()
+
+	if ok, e := tree.ContainsAll(nil); !ok || e != nil {
+		t.Fail()
+	}
+	if ok, e := tree.ContainsAll([]TreeElement{Element{1}}); ok || !e.Equal(Element{1}) {
+		t.Fail()
+	}
+
+	for i := 0; i < 1000; i += 2 {
+		tree.Insert(Element{i})
+	}
+
+	// Small, unsorted and large, sorted batches.
+	small := []TreeElement{Element{10}, Element{4}, Element{998}}
+	var large []TreeElement
+	for i := 0; i < 1000; i += 2 {
+		large = append(large, Element{i}, Element{i})
+	}
+
+	if ok, e := tree.ContainsAll(small); !ok || e != nil {
+		t.Fail()
+	}
+	if ok, e := tree.ContainsAll(large); !ok || e != nil {
+		t.Fail()
+	}
+
+	small = append(small, Element{7}, Element{9})
+	if ok, e := tree.ContainsAll(small); ok || !e.Equal(Element{7}) {
+		t.Fail()
+	}
+	large = append(large[:500], append([]TreeElement{Element{499}, Element{501}}, large[500:]...)...)
+	if ok, e := tree.ContainsAll(large); ok || !e.Equal(Element{499}) {
+		t.Fail()
+	}
+	large = append(large, Element{2000})
+	large[0] = Element{1}
+	if ok, e := tree.ContainsAll(large); ok || !e.Equal(Element{1}) {
+		t.Fail()
+	}
+}
+
+func BenchmarkDeleteHeavy(b *testing.B) {
+	maxN := 100000
+	for i := 0; i < b.N; i++ {
+		tree := NewCapacity(2 * maxN)
+		for j := 0; j < maxN; j++ {
+			tree.Insert(Element{j})
+		}
+		for j := 0; j < maxN; j++ {
+			tree.Delete(Element{j})
+		}
+	}
+}
+
+func TestLeafIndices(t *testing.T) {
+	tree := New()
+
+	if l := tree.LeafIndices(); l == nil || len(l) != 0 {
+		t.Fail()
+	}
+
+	for _, v := range rand.Perm(100) {
+		tree.Insert(Element{v})
+	}
+	leaves := tree.LeafIndices()
+	if len(leaves) != 100 {
+		t.Fail()
+	}
+	for i, l := range leaves {
+		if !tree.IsLeaf(l) || !tree.GetValue(l).Equal(Element{i}) {
+			t.Fail()
+		}
+	}
+}
+
+func TestDefragment(t *testing.T) {
+	tree := New()
+
+	tree.Defragment()
+	if tree.Len() != 0 || !tree.Invariant() || tree.LeafScatter() != 0 {
+		t.Fail()
+	}
+
+	for i := 0; i < 10000; i++ {
+		tree.Insert(Element{rand.Intn(1000)})
+	}
+	for i := 0; i < 5000; i++ {
+		tree.Delete(Element{rand.Intn(1000)})
+	}
+	before := tree.ToSlice()
+	scatter := tree.LeafScatter()
+
+	tree.Defragment()
+
+	if tree.LeafScatter() != 0 || scatter <= 0 {
+		t.Fail()
+	}
+	after := tree.ToSlice()
+	if len(after) != len(before) || !tree.Invariant() {
+		t.Fail()
+	}
+	for i := range after {
+		if !after[i].Equal(before[i]) {
+			t.Fail()
+		}
+	}
+	if r, f, a := tree.MemoryReport(); r+f != a {
+		t.Fail()
+	}
+
+	// The tree works as usual afterwards.
+	for i := 0; i < 1000; i++ {
+		tree.Insert(Element{i})
+		tree.Delete(Element{i})
+	}
+	if tree.Len() != len(before) || !tree.Invariant() {
+		t.Fail()
+	}
+}
+
+func TestKeys(t *testing.T) {
+	tree := New()
+
+	for range tree.Keys() {
+		t.Fail()
+	}
+
+	for _, v := range rand.Perm(100) {
+		tree.Insert(Element{v})
+	}
+
+	sum := 0.0
+	i := 0
+	for k := range tree.Keys() {
+		if k != float64(i) {
+			t.Fail()
+		}
+		sum += k
+		i++
+	}
+	if i != 100 || sum != 4950 {
+		t.Fail()
+	}
+
+	// Early termination.
+	count := 0
+	for k := range tree.Keys() {
+		if k >= 10 {
+			break
+		}
+		count++
+	}
+	if count != 10 {
+		t.Fail()
+	}
+
+	desc := NewDescending()
+	desc.Insert(Element{1})
+	desc.Insert(Element{2})
+	var keys []float64
+	for k := range desc.Keys() {
+		keys = append(keys, k)
+	}
+	if len(keys) != 2 || keys[0] != 2 || keys[1] != 1 {
+		t.Fail()
+	}
+}
+
+func TestNodeArityHistogram(t *testing.T) {
+	tree := New()
+
+	if two, three, leaves := tree.NodeArityHistogram(); two != 0 || three != 0 || leaves != 0 {
+		t.Fail()
+	}
+	tree.Insert(Element{1})
+	if two, three, leaves := tree.NodeArityHistogram(); two != 0 || three != 0 || leaves != 1 {
+		t.Fail()
+	}
+	tree.Insert(Element{2})
+	tree.Insert(Element{3})
+	if two, three, leaves := tree.NodeArityHistogram(); two != 0 || three != 1 || leaves != 3 {
+		t.Fail()
+	}
+
+	for i := 4; i <= 1000; i++ {
+		tree.Insert(Element{i})
+	}
+	two, three, leaves := tree.NodeArityHistogram()
+	// Every inner node adds one or two more children than itself.
+	if leaves != 1000 || two+2*three != leaves-1 {
+		t.Fail()
+	}
+
+	s := tree.Stats()
+	if s.Len != 1000 || s.TwoNodes != two || s.ThreeNodes != three || s.ReachableNodes != two+three+leaves {
+		t.Fail()
+	}
+	if d, _ := tree.Depths(); s.Depth != d || s.ReachableNodes+s.FreeNodes != s.AllocatedNodes {
+		t.Fail()
+	}
+}
+
+func TestInsertTracked(t *testing.T) {
+	tree := New()
+
+	grows := 0
+	for i := 0; i < 1000; i++ {
+		if tree.InsertTracked(Element{i}) {
+			grows++
+		}
+	}
+	if grows == 0 || grows > 20 || tree.Len() != 1000 {
+		t.Fail()
+	}
+
+	tree.Reserve(2000)
+	for i := 1000; i < 2000; i++ {
+		if tree.InsertTracked(Element{i}) {
+			t.Fail()
+		}
+	}
+	if tree.Len() != 2000 || !tree.Invariant() {
+		t.Fail()
+	}
+}
+
+func TestSnapshotCopyOnWrite(t *testing.T) {
+	tree := New()
+	for i := 0; i < 100; i++ {
+		tree.Insert(Element{i})
+	}
+
+	s1 := tree.Snapshot()
+	s2 := tree.Snapshot()
+	l, _ := tree.Find(Element{50})
+
+	// Nothing is copied until the first modification.
+	if &s1.treeNodes[0] != &tree.treeNodes[0] || &s2.treeNodes[0] != &tree.treeNodes[0] {
+		t.Fail()
+	}
+
+	s1.Delete(Element{50})
+	tree.Insert(Element{500})
+	s2.Insert(Element{-1})
+
+	if s1.Len() != 99 || s2.Len() != 101 || tree.Len() != 101 {
+		t.Fail()
+	}
+	if !s1.Invariant() || !s2.Invariant() || !tree.Invariant() {
+		t.Fail()
+	}
+	if _, err := tree.Find(Element{-1}); err == nil {
+		t.Fail()
+	}
+	if _, err := s2.Find(Element{500}); err == nil {
+		t.Fail()
+	}
+	// Leaves stay valid in snapshots.
+	if !s2.GetValue(l).Equal(Element{50}) || !tree.GetValue(l).Equal(Element{50}) {
+		t.Fail()
+	}
+
+	// Snapshot of a snapshot.
+	s3 := s1.Snapshot()
+	s1.Insert(Element{50})
+	if s3.Len() != 99 || s1.Len() != 100 || !s3.Invariant() {
+		t.Fail()
+	}
+}
+
+func benchmarkSnapshotMutate(b *testing.B, snapshot func(*Tree23) *Tree23, mutations int) {
+	maxN := 100000
+	tree := NewCapacity(2 * maxN)
+	for i := 0; i < maxN; i++ {
+		tree.Insert(Element{i})
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		snapshot(tree)
+		for j := 0; j < mutations; j++ {
+			tree.Delete(Element{j})
+			tree.Insert(Element{j})
+		}
+	}
+}
+
+func BenchmarkSnapshot(b *testing.B) {
+	benchmarkSnapshotMutate(b, (*Tree23).Snapshot, 0)
+}
+
+func BenchmarkSnapshotClone(b *testing.B) {
+	benchmarkSnapshotMutate(b, (*Tree23).Clone, 0)
+}
+
+func BenchmarkSnapshotMutate(b *testing.B) {
+	benchmarkSnapshotMutate(b, (*Tree23).Snapshot, 10)
+}
+
+func BenchmarkSnapshotMutateClone(b *testing.B) {
+	benchmarkSnapshotMutate(b, (*Tree23).Clone, 10)
+}
+
+func TestSnapshotFrozen(t *testing.T) {
+	tree := New()
+	for i := 0; i < 100; i++ {
+		tree.Insert(Element{i})
+	}
+	tree.Freeze()
+	s := tree.Snapshot()
+	tree.Thaw()
+
+	tree.Delete(Element{1})
+	if s.Len() != 100 || !s.Invariant() || tree.Len() != 99 {
+		t.Fail()
+	}
+}
+
+func TestTxn(t *testing.T) {
+	tree := New()
+	for i := 0; i < 10; i++ {
+		tree.Insert(Element{i})
+	}
+
+	txn := tree.Begin()
+	txn.Insert(Element{10})
+	txn.Delete(Element{0})
+	txn.Insert(Element{11})
+
+	// Nothing is visible before Commit.
+	if tree.Len() != 10 {
+		t.Fail()
+	}
+	txn.Rollback()
+	txn.Commit()
+	if tree.Len() != 10 {
+		t.Fail()
+	}
+
+	txn.Insert(Element{10})
+	txn.Delete(Element{0})
+	txn.Insert(Element{0})
+	txn.Delete(Element{5})
+	tree.Insert(Element{20})
+	txn.Commit()
+
+	if tree.Len() != 11 || !tree.Invariant() {
+		t.Fail()
+	}
+	for _, v := range []int{0, 10, 20} {
+		if _, err := tree.Find(Element{v}); err != nil {
+			t.Fail()
+		}
+	}
+	if _, err := tree.Find(Element{5}); err == nil {
+		t.Fail()
+	}
+
+	// A frozen tree panics without applying anything.
+	txn.Insert(Element{30})
+	tree.Freeze()
+	if !panics(txn.Commit) || tree.Len() != 11 {
+		t.Fail()
+	}
+}
+
+func TestUndo(t *testing.T) {
+	tree := New()
+
+	if tree.Undo() {
+		t.Fail()
+	}
+
+	tree.Insert(ValueElement{1, 1})
+	tree.Insert(ValueElement{2, 1})
+	tree.Insert(ValueElement{2, 2})
+	tree.Insert(ValueElement{2, 1})
+
+	// Undo removes exactly the inserted leaf.
+	if !tree.Undo() || tree.Len() != 3 || tree.CountEqual(ValueElement{2, 1}) != 1 || !tree.Invariant() {
+		t.Fail()
+	}
+	// Only one level.
+	if tree.Undo() || tree.Len() != 3 {
+		t.Fail()
+	}
+
+	tree.Delete(ValueElement{2, 2})
+	if !tree.Undo() || tree.Len() != 3 || tree.CountEqual(ValueElement{2, 2}) != 1 || !tree.Invariant() {
+		t.Fail()
+	}
+
+	// Deleting something that does not exist can not be undone.
+	tree.Delete(ValueElement{5, 5})
+	if tree.Undo() {
+		t.Fail()
+	}
+
+	l, _ := tree.Find(ValueElement{1, 1})
+	tree.DeleteNode(l)
+	if !tree.Undo() || tree.CountEqual(ValueElement{1, 1}) != 1 {
+		t.Fail()
+	}
+
+	// Other modifications clear the undo.
+	tree.Insert(ValueElement{3, 3})
+	l, _ = tree.Find(ValueElement{3, 3})
+	tree.ChangeValue(l, ValueElement{3, 3})
+	if tree.Undo() {
+		t.Fail()
+	}
+
+	var hooked []TreeElement
+	tree.SetHooks(nil, func(e TreeElement) { hooked = append(hooked, e) })
+	tree.InsertWithKey(7, ValueElement{7, 7})
+	if !tree.Undo() || len(hooked) != 1 || hooked[0] != (ValueElement{7, 7}) || tree.Len() != 4 || !tree.Invariant() {
+		t.Fail()
+	}
+}
+
+func TestFindAllApprox(t *testing.T) {
+	tree := New()
+
+	if l := tree.FindAllApprox(1, 1); l == nil || len(l) != 0 {
+		t.Fail()
+	}
+
+	for i := 0; i < 10; i++ {
+		tree.Insert(Element{i * 10})
+		tree.Insert(Element{i * 10})
+	}
+
+	values := func(leaves []TreeNodeIndex) []int {
+		var v []int
+		for _, l := range leaves {
+			v = append(v, tree.GetValue(l).(Element).E)
+		}
+		return v
+	}
+
+	if v := values(tree.FindAllApprox(25, 5)); len(v) != 4 || v[0] != 20 || v[3] != 30 {
+		t.Fail()
+	}
+	if v := values(tree.FindAllApprox(40, 0)); len(v) != 2 || v[0] != 40 || v[1] != 40 {
+		t.Fail()
+	}
+	if len(tree.FindAllApprox(45, 4.9)) != 0 || len(tree.FindAllApprox(45, -10)) != 0 {
+		t.Fail()
+	}
+	if len(tree.FindAllApprox(0, 1000)) != 20 {
+		t.Fail()
+	}
+}
+
+func TestWalkInternal(t *testing.T) {
+	tree := New()
+
+	New().WalkInternal(func(idx TreeNodeIndex, minKey, maxKey float64, level int) bool {
+		t.Fail()
+		return true
+	})
+
+	for _, v := range rand.Perm(1000) {
+		tree.Insert(Element{v})
+	}
+
+	nodes := 0
+	tree.WalkInternal(func(idx TreeNodeIndex, minKey, maxKey float64, level int) bool {
+		nodes++
+		if tree.IsLeaf(idx) || minKey > maxKey {
+			t.Fail()
+		}
+		if level == 0 && (idx != tree.root || minKey != 0 || maxKey != 999) {
+			t.Fail()
+		}
+		return true
+	})
+	two, three, _ := tree.NodeArityHistogram()
+	if nodes != two+three {
+		t.Fail()
+	}
+
+	// Only descend into nodes containing 500.
+	var levels []int
+	tree.WalkInternal(func(idx TreeNodeIndex, minKey, maxKey float64, level int) bool {
+		if minKey > 500 || maxKey < 500 {
+			return false
+		}
+		levels = append(levels, level)
+		return true
+	})
+	depth, _ := tree.Depths()
+	if len(levels) != depth-1 {
+		t.Fail()
+	}
+	for i, l := range levels {
+		if l != i {
+			t.Fail()
+		}
+	}
+
+	desc := NewDescending()
+	for i := 0; i < 10; i++ {
+		desc.Insert(Element{i})
+	}
+	desc.WalkInternal(func(idx TreeNodeIndex, minKey, maxKey float64, level int) bool {
+		if level == 0 && (minKey != 0 || maxKey != 9) {
+			t.Fail()
+		}
+		return false
+	})
+}
+
+func TestRangeWalk(t *testing.T) {
+	tree := New()
+
+	New().RangeWalk(0, 10, func(e TreeElement) bool {
+		t.Fail()
+		return true
+	})
+
+	for _, v := range rand.Perm(1000) {
+		tree.Insert(Element{v / 2})
+	}
+
+	check := func(low, high float64) {
+		var got []TreeElement
+		tree.RangeWalk(low, high, func(e TreeElement) bool {
+			got = append(got, e)
+			return true
+		})
+		want := tree.AppendValuesInRange(nil, low, high)
+		if len(got) != len(want) {
+			t.Fail()
+			return
+		}
+		for i := range got {
+			if !got[i].Equal(want[i]) {
+				t.Fail()
+			}
+		}
+	}
+	check(10, 20)
+	check(9.5, 20.5)
+	check(-100, 3)
+	check(495, 1000)
+	check(0, 499)
+	check(30, 20)
+	check(42, 42)
+	check(600, 700)
+
+	count := 0
+	tree.RangeWalk(0, 499, func(e TreeElement) bool {
+		count++
+		return count < 7
+	})
+	if count != 7 {
+		t.Fail()
+	}
+
+	desc := NewDescending()
+	for i := 0; i < 100; i++ {
+		desc.Insert(Element{i})
+	}
+	var got []int
+	desc.RangeWalk(10, 12, func(e TreeElement) bool {
+		got = append(got, e.(Element).E)
+		return true
+	})
+	if len(got) != 3 || got[0] != 12 || got[2] != 10 {
+		t.Fail()
+	}
+}
+
+func benchmarkRange(b *testing.B, walk func(tree *Tree23, low, high float64)) {
+	maxN := 1000000
+	tree := NewCapacity(2 * maxN)
+	for i := 0; i < maxN; i++ {
+		tree.Insert(Element{i})
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		low := float64(i % (maxN - 10))
+		walk(tree, low, low+10)
+	}
+}
+
+func BenchmarkRangeWalk(b *testing.B) {
+	benchmarkRange(b, func(tree *Tree23, low, high float64) {
+		tree.RangeWalk(low, high, func(TreeElement) bool { return true })
+	})
+}
+
+func BenchmarkRangeLeafWalk(b *testing.B) {
+	benchmarkRange(b, func(tree *Tree23, low, high float64) {
+		tree.ScanFrom(low, math.MaxInt, func(e TreeElement) bool { return e.ExtractValue() <= high })
+	})
+}
+
+func TestReplace(t *testing.T) {
+	tree := New()
+	for i := 0; i < 1000; i++ {
+		tree.Insert(Element{i})
+	}
+	memory := len(tree.treeNodes)
+
+	inserted, deleted := 0, 0
+	tree.SetHooks(func(TreeElement) { inserted++ }, func(TreeElement) { deleted++ })
+
+	var elems []TreeElement
+	for _, v := range rand.Perm(500) {
+		elems = append(elems, ValueElement{v % 50, v % 3})
+	}
+	first := elems[0]
+	tree.Replace(elems)
+
+	if tree.Len() != 500 || !tree.Invariant() || !checkContiguous(tree) {
+		t.Fail()
+	}
+	if inserted != 500 || deleted != 1000 || elems[0] != first {
+		t.Fail()
+	}
+	if len(tree.treeNodes) != memory {
+		t.Fail()
+	}
+	if tree.CountEqual(ValueElement{10, 1}) != 4 || tree.CountEqual(ValueElement{10, 2}) != 3 {
+		t.Fail()
+	}
+
+	tree.Replace(nil)
+	if tree.Len() != 0 || !tree.Invariant() {
+		t.Fail()
+	}
+	tree.Insert(ValueElement{1, 1})
+	if tree.Len() != 1 || !tree.Invariant() {
+		t.Fail()
+	}
+
+	tree.Clear()
+	if tree.Len() != 0 || !tree.Invariant() {
+		t.Fail()
+	}
+
+	// A set keeps only the first of equal elements.
+	set := NewSet()
+	inserted = 0
+	set.SetHooks(func(TreeElement) { inserted++ }, nil)
+	set.Replace([]TreeElement{countedElement{5, 1}, countedElement{1, 1}, countedElement{5, 2}, countedElement{5, 3}})
+	if s := set.ToSlice(); len(s) != 2 || s[1].(countedElement).Count != 1 || inserted != 2 || !set.Invariant() {
+		t.Fail()
+	}
+}
+
+func TestBuildFromSorted(t *testing.T) {
+	var elems []TreeElement
+	for i := 0; i < 1000; i++ {
+		elems = append(elems, ValueElement{i / 10, i % 2})
+	}
+	tree, err := BuildFromSorted(elems)
+	if err != nil || tree.Len() != 1000 || !tree.Invariant() || !checkContiguous(tree) {
+		t.Fail()
+	}
+	for i := 0; i < 100; i++ {
+		tree.Delete(ValueElement{i, 0})
+		tree.Insert(ValueElement{i, 1})
+	}
+	if tree.Len() != 1000 || !tree.Invariant() || !checkContiguous(tree) {
+		t.Fail()
+	}
+
+	if tree, err := BuildFromSorted(nil); err != nil || tree.Len() != 0 || !tree.Invariant() {
+		t.Fail()
+	}
+	if _, err := BuildFromSorted([]TreeElement{Element{2}, Element{1}}); err == nil {
+		t.Fail()
+	}
+}
+
+func TestCachedExtremes(t *testing.T) {
+	tree := New()
+
+	check := func(min, max int) {
+		s, err1 := tree.GetSmallestLeaf()
+		l, err2 := tree.GetLargestLeaf()
+		if err1 != nil || err2 != nil || !tree.Invariant() {
+			t.Fail()
+			return
+		}
+		if tree.GetValue(s).(Element).E != min || tree.GetValue(l).(Element).E != max {
+			t.Fail()
+		}
+	}
+
+	tree.Insert(Element{5})
+	check(5, 5)
+	tree.Insert(Element{3})
+	check(3, 5)
+	tree.Insert(Element{3})
+	check(3, 5)
+	tree.Insert(Element{9})
+	check(3, 9)
+
+	// Delete the extremes one after another.
+	tree.Delete(Element{3})
+	check(3, 9)
+	tree.Delete(Element{3})
+	check(5, 9)
+	tree.Delete(Element{9})
+	check(5, 5)
+	tree.Delete(Element{5})
+	if _, err := tree.GetSmallestLeaf(); err == nil || !tree.Invariant() {
+		t.Fail()
+	}
+
+	for i := 0; i < 1000; i++ {
+		tree.Insert(Element{i})
+	}
+	for i := 0; i < 500; i++ {
+		l, _ := tree.GetSmallestLeaf()
+		tree.DeleteNode(l)
+		l, _ = tree.GetLargestLeaf()
+		tree.DeleteNode(l)
+		if tree.Len() > 0 {
+			check(i+1, 998-i)
+		}
+	}
+	if tree.Len() != 0 || !tree.Invariant() {
+		t.Fail()
+	}
+
+	// Random inserts and deletes.
+	min, max := 1000, -1
+	for i := 0; i < 2000; i++ {
+		v := rand.Intn(1000)
+		tree.Insert(Element{v})
+		if v < min {
+			min = v
+		}
+		if v > max {
+			max = v
+		}
+		check(min, max)
+	}
+	for tree.Len() > 0 {
+		pq := PriorityQueue{tree}
+		e, _ := pq.Pop()
+		if e.(Element).E < min {
+			t.Fail()
+		}
+		min = e.(Element).E
+		if tree.Len() > 0 && !tree.Invariant() {
+			t.Fail()
+		}
+	}
+}
+
+func TestMergeWalk(t *testing.T) {
+	a := New()
+	b := New()
+
+	MergeWalk(a, b, func(fromA, fromB TreeElement, cmp int) {
+		t.Fail()
+	})
+
+	for _, v := range []int{1, 3, 3, 5, 9} {
+		a.Insert(Element{v})
+	}
+	for _, v := range []int{0, 3, 5, 5, 10, 11} {
+		b.Insert(Element{v})
+	}
+
+	type step struct{ a, b, cmp int }
+	want := []step{{-1, 0, 1}, {1, -1, -1}, {3, 3, 0}, {3, -1, -1}, {5, 5, 0}, {-1, 5, 1}, {9, -1, -1}, {-1, 10, 1}, {-1, 11, 1}}
+	var got []step
+	value := func(e TreeElement) int {
+		if e == nil {
+			return -1
+		}
+		return e.(Element).E
+	}
+	MergeWalk(a, b, func(fromA, fromB TreeElement, cmp int) {
+		got = append(got, step{value(fromA), value(fromB), cmp})
+	})
+
+	if len(got) != len(want) {
+		t.Fail()
+	}
+	for i := range got {
+		if i < len(want) && got[i] != want[i] {
+			t.Fail()
+		}
+	}
+	if a.Len() != 5 || b.Len() != 6 {
+		t.Fail()
+	}
+
+	// Intersection with an empty tree.
+	count := 0
+	MergeWalk(a, New(), func(fromA, fromB TreeElement, cmp int) {
+		if cmp != -1 || fromB != nil {
+			t.Fail()
+		}
+		count++
+	})
+	if count != 5 {
+		t.Fail()
+	}
+}
+
+// FloatElement has a float value, so it can be infinite.
+type FloatElement struct {
+	V float64
+}
+
+func (e FloatElement) Equal(e2 TreeElement) bool {
+	return e.V == e2.(FloatElement).V
+}
+func (e FloatElement) ExtractValue() float64 {
+	return e.V
+}
+func (e FloatElement) MarshalBinary() ([]byte, error) {
+	return binary.LittleEndian.AppendUint64(nil, math.Float64bits(e.V)), nil
+}
+
+func TestInfinity(t *testing.T) {
+	inf := math.Inf(1)
+
+	for _, tree := range []*Tree23{New(), NewDescending()} {
+		for i := 0; i < 10; i++ {
+			tree.Insert(FloatElement{float64(i)})
+		}
+		tree.Insert(FloatElement{inf})
+		tree.Insert(FloatElement{-inf})
+		tree.Insert(FloatElement{inf})
+
+		if tree.Len() != 13 || !tree.Invariant() {
+			t.Fail()
+		}
+		value := func(l TreeNodeIndex, err error) float64 {
+			if err != nil {
+				return math.NaN()
+			}
+			return tree.GetValue(l).ExtractValue()
+		}
+
+		if all := tree.AppendValuesInRange(nil, -inf, inf); len(all) != 13 {
+			t.Fail()
+		}
+		if upper := tree.AppendValuesInRange(nil, 9.5, inf); len(upper) != 2 {
+			t.Fail()
+		}
+		count := 0
+		tree.RangeWalk(-inf, 0, func(TreeElement) bool { count++; return true })
+		if count != 2 {
+			t.Fail()
+		}
+		if l, err := tree.Find(FloatElement{-inf}); err != nil || tree.GetValue(l).ExtractValue() != -inf {
+			t.Fail()
+		}
+		if tree.CountEqual(FloatElement{inf}) != 2 {
+			t.Fail()
+		}
+		if _, err := tree.FindInterpolated(FloatElement{5}); err != nil {
+			t.Fail()
+		}
+		if _, err := tree.FindAtFraction(0.5); err == nil {
+			t.Fail()
+		}
+		if tree.Histogram(-inf, inf, 4) != nil {
+			t.Fail()
+		}
+		if v := value(tree.FindApprox(inf, 1)); v != inf {
+			t.Fail()
+		}
+
+		if !tree.descending {
+			if v := value(tree.FindFirstLargerLeaf(inf)); v != inf {
+				t.Fail()
+			}
+			if v := value(tree.FindFirstStrictlyLargerLeaf(9)); v != inf {
+				t.Fail()
+			}
+			if v := value(tree.FindLastSmallerOrEqualLeaf(-1)); v != -inf {
+				t.Fail()
+			}
+			if v := value(tree.FindLastSmallerLeaf(-inf)); !math.IsNaN(v) {
+				t.Fail()
+			}
+			if v := value(tree.FindAtFraction(0)); v != -inf {
+				t.Fail()
+			}
+			if v := value(tree.GetLargestLeaf()); v != inf {
+				t.Fail()
+			}
+		}
+
+		tree.Delete(FloatElement{inf})
+		tree.Delete(FloatElement{-inf})
+		if tree.Len() != 11 || !tree.Invariant() {
+			t.Fail()
+		}
+	}
+}
+
+func TestDeleteMinMax(t *testing.T) {
+	tree := New()
+
+	if tree.DeleteMin() || tree.DeleteMax() {
+		t.Fail()
+	}
+
+	for _, v := range rand.Perm(100) {
+		tree.Insert(Element{v})
+	}
+	for i := 0; i < 50; i++ {
+		if !tree.DeleteMin() || !tree.DeleteMax() {
+			t.Fail()
+		}
+		if tree.Len() > 0 {
+			min, _ := tree.MinValue()
+			max, _ := tree.MaxValue()
+			if min != float64(i+1) || max != float64(98-i) || !tree.Invariant() {
+				t.Fail()
+			}
+		}
+	}
+	if tree.Len() != 0 || tree.DeleteMin() || tree.DeleteMax() || !tree.Invariant() {
+		t.Fail()
+	}
+
+	tree.Insert(Element{1})
+	if !tree.DeleteMax() || tree.Len() != 0 {
+		t.Fail()
+	}
+}
+
+func TestMemoryBytes(t *testing.T) {
+	tree := NewCapacity(100)
+	small := tree.MemoryBytes()
+	if small <= 0 {
+		t.Fail()
+	}
+
+	for i := 0; i < 1000; i++ {
+		tree.Insert(Element{i})
+	}
+	large := tree.MemoryBytes()
+	if large < 1000*small/100 {
+		t.Fail()
+	}
+
+	for i := 0; i < 1000; i++ {
+		tree.Delete(Element{i})
+	}
+	// Deleting keeps the memory and fills the stack of recycled nodes.
+	if tree.MemoryBytes() < large {
+		t.Fail()
+	}
+}
+
+func TestRelinkLeaves(t *testing.T) {
+	for _, n := range []int{1, 2, 3, 4, 5, 100, 1000} {
+		var elems []TreeElement
+		for i := 0; i < n; i++ {
+			elems = append(elems, Element{i})
+		}
+		tree, _ := BuildFromSorted(elems)
+		if !tree.CheckLeafList() || !tree.Invariant() {
+			t.Fail()
+		}
+
+		// Break all links and restore them.
+		for _, l := range tree.LeafIndices() {
+			tree.treeNodes[l].prev = -1
+			tree.treeNodes[l].next = -1
+		}
+		tree.RelinkLeaves()
+		if !tree.CheckLeafList() || !tree.Invariant() {
+			t.Fail()
+		}
+		if s := tree.ToSlice(); len(s) != n || !s[n-1].Equal(Element{n - 1}) {
+			t.Fail()
+		}
+	}
+}
+
+func TestUpdateKey(t *testing.T) {
+	tree := New()
+	for i := 0; i < 100; i++ {
+		tree.Insert(ValueElement{i, i})
+	}
+
+	l, _ := tree.Find(ValueElement{10, 10})
+	n, err := tree.UpdateKey(l, ValueElement{1000, 10})
+	if err != nil || !tree.GetValue(n).Equal(ValueElement{1000, 10}) {
+		t.Fail()
+	}
+	if l, _ := tree.GetLargestLeaf(); l != n {
+		t.Fail()
+	}
+	if _, err := tree.Find(ValueElement{10, 10}); err == nil {
+		t.Fail()
+	}
+	if tree.Len() != 100 || !tree.Invariant() {
+		t.Fail()
+	}
+	if ok, _ := tree.CheckOrdering(); !ok {
+		t.Fail()
+	}
+
+	if _, err := tree.UpdateKey(-1, ValueElement{5, 5}); err == nil {
+		t.Fail()
+	}
+
+	set := NewSet()
+	set.Insert(Element{1})
+	set.Insert(Element{2})
+	l, _ = set.Find(Element{1})
+	if n, err := set.UpdateKey(l, Element{2}); err == nil || n != -1 || set.Len() != 2 {
+		t.Fail()
+	}
+	if n, err := set.UpdateKey(l, Element{1}); err != nil || !set.GetValue(n).Equal(Element{1}) || set.Len() != 2 {
+		t.Fail()
+	}
+
+	// Undo restores the old element and removes the new one.
+	l, _ = tree.Find(ValueElement{20, 20})
+	if _, err := tree.UpdateKey(l, ValueElement{-5, 20}); err != nil || !tree.Undo() {
+		t.Fail()
+	}
+	if _, err := tree.Find(ValueElement{20, 20}); err != nil {
+		t.Fail()
+	}
+	if _, err := tree.Find(ValueElement{-5, 20}); err == nil || tree.Len() != 100 || !tree.Invariant() || tree.Undo() {
+		t.Fail()
+	}
+}
+
+func TestSetInvariantChecks(t *testing.T) {
+	tree := New()
+	tree.SetInvariantChecks(true)
+
+	if panics(func() {
+		for i := 0; i < 1000; i++ {
+			tree.Insert(Element{(i * 37) % 101})
+		}
+		for i := 0; i < 500; i++ {
+			tree.Delete(Element{i % 101})
+		}
+		l, _ := tree.GetSmallestLeaf()
+		tree.DeleteNode(l)
+	}) {
+		t.Fail()
+	}
+
+	// Corrupt the leaf list. The next modification has to panic.
+	l, _ := tree.GetSmallestLeaf()
+	tree.treeNodes[l].next = l
+	if !panics(func() { tree.Insert(Element{5}) }) {
+		t.Fail()
+	}
+
+	tree = New()
+	for i := 0; i < 10; i++ {
+		tree.Insert(Element{i})
+	}
+	l, _ = tree.GetSmallestLeaf()
+	tree.ChangeValueUnsafe(l, Element{100})
+	if panics(func() { tree.Insert(Element{20}) }) {
+		t.Fail()
+	}
+	tree.SetInvariantChecks(true)
+	if !panics(func() { tree.Insert(Element{30}) }) {
+		t.Fail()
+	}
+}
+
+func TestCountEqualInterleaved(t *testing.T) {
+	tree := New()
+	// Interleave elements with the same value, but different IDs.
+	for i := 0; i < 30; i++ {
+		tree.Insert(ValueElement{5, i % 3})
+		tree.Insert(ValueElement{i % 7, 10})
+	}
+
+	for id := 0; id < 3; id++ {
+		if tree.CountEqual(ValueElement{5, id}) != 10 {
+			t.Fail()
+		}
+	}
+	if tree.CountEqual(ValueElement{5, 10}) != 4 || tree.CountEqual(ValueElement{5, 3}) != 0 {
+		t.Fail()
+	}
+	if tree.CountEqual(ValueElement{6, 10}) != 4 || tree.CountEqual(ValueElement{8, 10}) != 0 {
+		t.Fail()
+	}
+
+	tree.Delete(ValueElement{5, 1})
+	if tree.CountEqual(ValueElement{5, 1}) != 9 || tree.CountEqual(ValueElement{5, 0}) != 10 {
+		t.Fail()
+	}
+	if New().CountEqual(Element{1}) != 0 {
+		t.Fail()
+	}
+}
+
+func TestNextPrevValue(t *testing.T) {
+	tree := New()
+	if _, ok := tree.NextValue(Element{1}); ok {
+		t.Fail()
+	}
+	for i := 0; i < 10; i++ {
+		tree.Insert(Element{i * 2})
+	}
+	tree.Insert(Element{4})
+
+	if e, ok := tree.NextValue(Element{4}); !ok || !e.Equal(Element{6}) {
+		t.Fail()
+	}
+	if e, ok := tree.PrevValue(Element{4}); !ok || !e.Equal(Element{2}) {
+		t.Fail()
+	}
+	if _, ok := tree.NextValue(Element{18}); ok {
+		t.Fail()
+	}
+	if _, ok := tree.PrevValue(Element{0}); ok {
+		t.Fail()
+	}
+	if _, ok := tree.NextValue(Element{5}); ok {
+		t.Fail()
+	}
+
+	desc := NewDescending()
+	for i := 0; i < 10; i++ {
+		desc.Insert(Element{i})
+	}
+	if e, ok := desc.NextValue(Element{5}); !ok || !e.Equal(Element{4}) {
+		t.Fail()
+	}
+	if _, ok := desc.PrevValue(Element{9}); ok {
+		t.Fail()
+	}
+}
+
+func TestFreeze2Array(t *testing.T) {
+	tree := New()
+	for i := 0; i < 100; i++ {
+		tree.Insert(Element{(i * 7) % 100 * 2})
+	}
+	arr := tree.Freeze2Array()
+	if len(arr) != 100 {
+		t.Fail()
+	}
+	for i, e := range arr {
+		if !e.Equal(Element{i * 2}) {
+			t.Fail()
+		}
+	}
+
+	if SearchArray(arr, 10) != 5 || SearchArray(arr, 11) != 6 || SearchArray(arr, -1) != 0 || SearchArray(arr, 1000) != 100 {
+		t.Fail()
+	}
+
+	// The array is independent of the tree.
+	tree.Delete(Element{0})
+	tree.Insert(Element{1})
+	if !arr[0].Equal(Element{0}) || !arr[1].Equal(Element{2}) {
+		t.Fail()
+	}
+
+	desc := NewDescending()
+	for i := 0; i < 10; i++ {
+		desc.Insert(Element{i})
+	}
+	if arr := desc.Freeze2Array(); SearchArray(arr, 3) != 3 || !arr[9].Equal(Element{9}) {
+		t.Fail()
+	}
+	if SearchArray(New().Freeze2Array(), 1) != 0 {
+		t.Fail()
+	}
+}
+
+type countingMetrics struct {
+	inserts, deletes, finds, misses, maxDepth int
+}
+
+func (m *countingMetrics) ObserveInsert(depth int) {
+	m.inserts++
+	if depth > m.maxDepth {
+		m.maxDepth = depth
+	}
+}
+func (m *countingMetrics) ObserveDelete(depth int) { m.deletes++ }
+func (m *countingMetrics) ObserveFind(depth int, found bool) {
+	m.finds++
+	if !found {
+		m.misses++
+	}
+}
+
+func TestSetMetrics(t *testing.T) {
+	tree := New()
+	m := &countingMetrics{}
+	tree.SetMetrics(m)
+
+	tree.Find(Element{1})
+	for i := 0; i < 1000; i++ {
+		tree.Insert(Element{i})
+	}
+	for i := 0; i < 100; i++ {
+		tree.Find(Element{i * 20})
+	}
+	tree.Delete(Element{5})
+	l, _ := tree.GetSmallestLeaf()
+	tree.DeleteNode(l)
+
+	minDepth, _ := tree.Depths()
+	if m.inserts != 1000 || m.deletes != 2 || m.finds != 101 || m.misses != 51 || m.maxDepth != minDepth-1 {
+		t.Fail()
+	}
+
+	tree.SetMetrics(nil)
+	tree.Insert(Element{1})
+	if m.inserts != 1000 {
+		t.Fail()
+	}
+}
+
+func TestRelease(t *testing.T) {
+	tree := NewDescending()
+	deleted := 0
+	tree.SetHooks(nil, func(TreeElement) { deleted++ })
+	for i := 0; i < 10000; i++ {
+		tree.Insert(Element{i})
+	}
+
+	tree.Release()
+	if tree.Len() != 0 || deleted != 10000 || !tree.Invariant() || len(tree.treeNodes) != 1 {
+		t.Fail()
+	}
+
+	// The tree keeps its order and hooks.
+	for i := 0; i < 100; i++ {
+		tree.Insert(Element{i})
+	}
+	tree.Delete(Element{0})
+	if l, _ := tree.GetSmallestLeaf(); tree.Len() != 99 || deleted != 10001 || !tree.GetValue(l).Equal(Element{99}) || !tree.Invariant() {
+		t.Fail()
+	}
+
+	tree.Freeze()
+	if !panics(tree.Release) {
+		t.Fail()
+	}
+}
+
+func TestValue(t *testing.T) {
+	tree := New()
+	if _, ok := tree.Value(0); ok {
+		t.Fail()
+	}
+	for i := 0; i < 100; i++ {
+		tree.Insert(Element{i})
+	}
+
+	l, _ := tree.Find(Element{42})
+	if e, ok := tree.Value(l); !ok || !e.Equal(Element{42}) {
+		t.Fail()
+	}
+	for _, i := range []TreeNodeIndex{-1, tree.root, TreeNodeIndex(len(tree.treeNodes)), 1 << 30} {
+		if e, ok := tree.Value(i); ok || e != nil {
+			t.Fail()
+		}
+	}
+
+	tree.Delete(Element{42})
+	if _, ok := tree.Value(l); ok {
+		t.Fail()
+	}
+}
+
+func TestSetTieBreaker(t *testing.T) {
+	byID := func(a, b TreeElement) bool { return a.(ValueElement).ID < b.(ValueElement).ID }
+
+	tree := New()
+	tree.SetTieBreaker(byID)
+	tree.SetInvariantChecks(true)
+	for i := 0; i < 500; i++ {
+		tree.Insert(ValueElement{(i * 7) % 5, (i * 13) % 50})
+	}
+
+	// Leaves are sorted by value first and by ID among the same values.
+	last := ValueElement{-1, 0}
+	for _, e := range tree.ToSlice() {
+		v := e.(ValueElement)
+		if v.V < last.V || v.V == last.V && v.ID < last.ID {
+			t.Fail()
+		}
+		last = v
+	}
+	if ok, _ := tree.CheckOrdering(); !ok || !tree.Invariant() {
+		t.Fail()
+	}
+	for id := 0; id < 50; id++ {
+		for v := 0; v < 5; v++ {
+			want := 0
+			for i := 0; i < 500; i++ {
+				if (i*7)%5 == v && (i*13)%50 == id {
+					want++
+				}
+			}
+			if tree.CountEqual(ValueElement{v, id}) != want {
+				t.Fail()
+			}
+			if l, err := tree.Find(ValueElement{v, id}); (err == nil) != (want > 0) || err == nil && !tree.GetValue(l).Equal(ValueElement{v, id}) {
+				t.Fail()
+			}
+		}
+	}
+	if _, err := tree.Find(ValueElement{2, 50}); err == nil {
+		t.Fail()
+	}
+
+	// Setting the tie breaker on a filled tree reorders it.
+	tree = New()
+	for i := 10; i > 0; i-- {
+		tree.Insert(ValueElement{1, i})
+	}
+	tree.SetTieBreaker(byID)
+	for i, e := range tree.ToSlice() {
+		if !e.Equal(ValueElement{1, i + 1}) {
+			t.Fail()
+		}
+	}
+	tree.Insert(ValueElement{1, 0})
+	if l, _ := tree.GetSmallestLeaf(); !tree.GetValue(l).Equal(ValueElement{1, 0}) || !tree.Invariant() {
+		t.Fail()
+	}
+	tree.Replace([]TreeElement{ValueElement{1, 3}, ValueElement{0, 9}, ValueElement{1, 2}})
+	if s := tree.ToSlice(); !s[1].Equal(ValueElement{1, 2}) || !s[2].Equal(ValueElement{1, 3}) || !tree.Invariant() {
+		t.Fail()
+	}
+	l, _ := tree.GetLargestLeaf()
+	tree.InsertWithHint(l, ValueElement{1, 1})
+	if s := tree.ToSlice(); !s[1].Equal(ValueElement{1, 1}) || !tree.Invariant() {
+		t.Fail()
+	}
+}
+
+func TestForEachLevel(t *testing.T) {
+	New().ForEachLevel(func(level int, nodes []TreeNodeIndex) {
+		t.Fail()
+	})
+
+	tree := New()
+	for i := 0; i < 1000; i++ {
+		tree.Insert(Element{i})
+	}
+
+	levels := 0
+	count := 0
+	var leaves []TreeNodeIndex
+	tree.ForEachLevel(func(level int, nodes []TreeNodeIndex) {
+		if level != levels || level == 0 && (len(nodes) != 1 || nodes[0] != tree.root) {
+			t.Fail()
+		}
+		levels++
+		count += len(nodes)
+		leaves = append(leaves[:0], nodes...)
+	})
+
+	depth, _ := tree.Depths()
+	reachable, _, _ := tree.MemoryReport()
+	if levels != depth || count != reachable || len(leaves) != 1000 {
+		t.Fail()
+	}
+	for i, l := range leaves {
+		if !tree.IsLeaf(l) || !tree.GetValue(l).Equal(Element{i}) {
+			t.Fail()
+		}
+	}
+}
+
+func TestAreAdjacent(t *testing.T) {
+	tree := New()
+	for i := 0; i < 10; i++ {
+		tree.Insert(Element{i})
+	}
+	leaves := tree.LeafIndices()
+
+	for i := 0; i < 10; i++ {
+		for j := 0; j < 10; j++ {
+			want := i-j == 1 || j-i == 1
+			if tree.AreAdjacent(leaves[i], leaves[j]) != want {
+				t.Fail()
+			}
+		}
+	}
+	if tree.AreAdjacent(tree.root, leaves[0]) || tree.AreAdjacent(-1, leaves[0]) || tree.AreAdjacent(leaves[0], 1<<20) {
+		t.Fail()
+	}
+
+	tree = New()
+	tree.Insert(Element{1})
+	l, _ := tree.GetSmallestLeaf()
+	if tree.AreAdjacent(l, l) {
+		t.Fail()
+	}
+	tree.Insert(Element{2})
+	r, _ := tree.GetLargestLeaf()
+	if !tree.AreAdjacent(l, r) || !tree.AreAdjacent(r, l) {
+		t.Fail()
+	}
+}
+
+func TestDumpStructure(t *testing.T) {
+	tree := NewDescending()
+	for i := 0; i < 1000; i++ {
+		tree.Insert(Element{(i * 17) % 300})
+	}
+	for i := 0; i < 200; i++ {
+		tree.Delete(Element{i})
+	}
+
+	dump, err := tree.DumpStructure()
+	if err != nil {
+		t.Fail()
+	}
+	loaded, err := LoadStructure(dump, makeElement)
+	if err != nil || !loaded.Invariant() || loaded.Len() != tree.Len() {
+		t.Fail()
+	}
+	if loaded.root != tree.root || len(loaded.treeNodes) != len(tree.treeNodes) || loaded.treeNodesFreePositions.len() != tree.treeNodesFreePositions.len() {
+		t.Fail()
+	}
+	for _, l := range tree.LeafIndices() {
+		if e, ok := loaded.Value(l); !ok || !e.Equal(tree.GetValue(l)) {
+			t.Fail()
+		}
+	}
+	if again, _ := loaded.DumpStructure(); !bytes.Equal(dump, again) {
+		t.Fail()
+	}
+
+	// The loaded tree can be used normally.
+	loaded.Insert(Element{1000})
+	if l, _ := loaded.GetSmallestLeaf(); !loaded.GetValue(l).Equal(Element{1000}) || !loaded.Invariant() {
+		t.Fail()
+	}
+
+	for _, d := range [][]byte{nil, []byte("T23S1"), dump[:len(dump)-1], append(dump, 0)} {
+		if _, err := LoadStructure(d, makeElement); err == nil {
+			t.Fail()
+		}
+	}
+
+	if _, err := NewSet().DumpStructure(); err != nil {
+		t.Fail()
+	}
+	tree = New()
+	tree.Insert(ValueElement{1, 1})
+	if _, err := tree.DumpStructure(); err == nil {
+		t.Fail()
+	}
+}
+
+func TestLoadStructureSize(t *testing.T) {
+	header := func(size, used uint64) []byte {
+		b := []byte(structureMagic)
+		b = binary.AppendUvarint(b, 0)
+		b = binary.AppendVarint(b, 0)
+		b = binary.AppendUvarint(b, 0)
+		b = binary.AppendVarint(b, -1)
+		b = binary.AppendUvarint(b, size)
+		return binary.AppendUvarint(b, used)
+	}
+	// Headers claiming far more nodes than the data contains.
+	for _, d := range [][]byte{header(math.MaxInt32, 1), header(math.MaxInt32, math.MaxInt32), header(1<<62, 1<<62), header(1<<20, 1<<20)[:12]} {
+		if _, err := LoadStructure(d, makeElement); err == nil {
+			t.Fail()
+		}
+	}
+
+	// Unused memory of a large tree is not recorded completely, but the dump still round trips.
+	tree := NewCapacity(1 << 20)
+	for i := 0; i < 10; i++ {
+		tree.Insert(Element{i})
+	}
+	dump, _ := tree.DumpStructure()
+	loaded, err := LoadStructure(dump, makeElement)
+	if err != nil || len(loaded.treeNodes) != structureMinCapacity || !loaded.EqualsSlice(tree.ToSlice()) {
+		t.Fail()
+	}
+	if again, _ := loaded.DumpStructure(); !bytes.Equal(dump, again) {
+		t.Fail()
+	}
+}
+
+func TestLoadStructureEmpty(t *testing.T) {
+	dump, _ := NewSet().DumpStructure()
+	tree, err := LoadStructure(dump, makeElement)
+	if err != nil || tree.Len() != 0 || !tree.Invariant() || !tree.InsertUnique(Element{1}) || tree.InsertUnique(Element{1}) {
+		t.Fail()
+	}
+}
+
+func TestCheckMaxChildren(t *testing.T) {
+	if ok, n := New().CheckMaxChildren(); !ok || n != -1 {
+		t.Fail()
+	}
+
+	tree := New()
+	for i := 0; i < 1000; i++ {
+		tree.Insert(Element{(i * 31) % 1000})
+	}
+	for i := 0; i < 500; i++ {
+		tree.Delete(Element{i * 2})
+	}
+	if ok, n := tree.CheckMaxChildren(); !ok || n != -1 {
+		t.Fail()
+	}
+
+	// Corrupt the maximum of one inner node below the root.
+	c := tree.treeNodes[tree.root].children[0].child
+	tree.treeNodes[c].children[0].maxChild += 0.5
+	if ok, n := tree.CheckMaxChildren(); ok || n != c || tree.Invariant() {
+		t.Fail()
+	}
+	tree.treeNodes[c].children[0].maxChild -= 0.5
+	tree.treeNodes[tree.root].children[0].maxChild = -1
+	if ok, n := tree.CheckMaxChildren(); ok || n != tree.root {
+		t.Fail()
+	}
+}
+
+func TestCountDistinct(t *testing.T) {
+	tree := New()
+	if tree.CountDistinct() != 0 {
+		t.Fail()
+	}
+	tree.Insert(ValueElement{1, -1})
+	if tree.CountDistinct() != 1 {
+		t.Fail()
+	}
+	for i := 0; i < 100; i++ {
+		tree.Insert(ValueElement{i % 10, i})
+	}
+	if tree.CountDistinct() != 10 || tree.Len() != 101 {
+		t.Fail()
+	}
+
+	desc := NewDescending()
+	for i := 0; i < 100; i++ {
+		desc.Insert(Element{i % 7})
+	}
+	if desc.CountDistinct() != 7 {
+		t.Fail()
+	}
+}
+
+func TestMaxGap(t *testing.T) {
+	tree := New()
+	if _, _, _, err := tree.MaxGap(); err == nil {
+		t.Fail()
+	}
+	tree.Insert(Element{5})
+	if _, _, _, err := tree.MaxGap(); err == nil {
+		t.Fail()
+	}
+	tree.Insert(Element{5})
+	if lower, upper, gap, err := tree.MaxGap(); err != nil || lower != 5 || upper != 5 || gap != 0 {
+		t.Fail()
+	}
+
+	for _, tree := range []*Tree23{New(), NewDescending()} {
+		for _, v := range []int{1, 3, 10, 14, 21, 30, 31} {
+			tree.Insert(Element{v})
+		}
+		if lower, upper, gap, err := tree.MaxGap(); err != nil || lower != 21 || upper != 30 || gap != 9 {
+			t.Fail()
+		}
+		// Ties are resolved to the smallest values.
+		tree.Insert(Element{0})
+		tree.Insert(Element{-9})
+		if lower, upper, gap, err := tree.MaxGap(); err != nil || lower != -9 || upper != 0 || gap != 9 {
+			t.Fail()
+		}
+	}
+}
+
+func TestTrim(t *testing.T) {
+	for _, tree := range []*Tree23{New(), NewDescending()} {
+		deleted := 0
+		tree.SetHooks(nil, func(TreeElement) { deleted++ })
+		for i := 0; i < 1000; i++ {
+			tree.Insert(Element{i % 500})
+		}
+
+		if tree.Trim(-10, 1000) != 0 || tree.Len() != 1000 {
+			t.Fail()
+		}
+		if tree.Trim(100, 199.5) != 800 || deleted != 800 || tree.Len() != 200 || !tree.Invariant() {
+			t.Fail()
+		}
+		min, _ := tree.MinValue()
+		max, _ := tree.MaxValue()
+		if tree.descending {
+			min, max = max, min
+		}
+		if min != 100 || max != 199 || tree.CountEqual(Element{150}) != 2 {
+			t.Fail()
+		}
+		if tree.Trim(1, 0) != 200 || tree.Len() != 0 || !tree.Invariant() {
+			t.Fail()
+		}
+		if tree.Trim(0, 1) != 0 {
+			t.Fail()
+		}
+	}
+}
+
+func TestRangeBounds(t *testing.T) {
+	if _, _, err := New().RangeBounds(0, 1); err == nil {
+		t.Fail()
+	}
+
+	for _, tree := range []*Tree23{New(), NewDescending()} {
+		for i := 0; i < 100; i++ {
+			tree.Insert(Element{(i % 50) * 2})
+		}
+
+		start, end, err := tree.RangeBounds(9, 20)
+		if err != nil {
+			t.Fail()
+		}
+		var values []int
+		for l := start; ; l, _ = tree.Next(l) {
+			values = append(values, tree.GetValue(l).(Element).E)
+			if l == end {
+				break
+			}
+		}
+		if len(values) != 12 {
+			t.Fail()
+		}
+		first, last := values[0], values[len(values)-1]
+		if tree.descending {
+			first, last = last, first
+		}
+		if first != 10 || last != 20 {
+			t.Fail()
+		}
+
+		if start, end, err := tree.RangeBounds(-100, 1000); err != nil || tree.GetValue(start).(Element).E+tree.GetValue(end).(Element).E != 98 {
+			t.Fail()
+		}
+		for _, r := range [][2]float64{{11, 11.5}, {-10, -1}, {99, 200}, {20, 10}} {
+			if _, _, err := tree.RangeBounds(r[0], r[1]); err == nil {
+				t.Fail()
+			}
+		}
+	}
+}
+
+func TestAtomicTree(t *testing.T) {
+	build := func(n int) *Tree23 {
+		tree := New()
+		for i := 0; i < n; i++ {
+			tree.Insert(Element{i})
+		}
+		return tree
+	}
+
+	var a AtomicTree
+	if a.Load() != nil {
+		t.Fail()
+	}
+	a.AtomicSwap(build(10))
+
+	done := make(chan bool)
+	failed := make(chan bool, 4)
+	for r := 0; r < 4; r++ {
+		go func() {
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				tree := a.Load()
+				// Every published tree contains all values up to its length.
+				if _, err := tree.Find(Element{tree.Len() - 1}); err != nil {
+					failed <- true
+					return
+				}
+			}
+		}()
+	}
+	for n := 20; n <= 200; n += 10 {
+		if old := a.AtomicSwap(build(n)); !old.IsFrozen() {
+			t.Fail()
+		}
+	}
+	close(done)
+
+	select {
+	case <-failed:
+		t.Fail()
+	default:
+	}
+	if tree := NewAtomicTree(build(5)).Load(); tree.Len() != 5 || !tree.IsFrozen() {
+		t.Fail()
+	}
+}
+
+func TestForEachShuffled(t *testing.T) {
+	tree := New()
+	for i := 0; i < 100; i++ {
+		tree.Insert(Element{i})
+	}
+
+	order := func(seed int64) []int {
+		var o []int
+		tree.ForEachShuffled(seed, func(e TreeElement) bool {
+			o = append(o, e.(Element).E)
+			return true
+		})
+		return o
+	}
+	a, b, c := order(1), order(1), order(2)
+	if len(a) != 100 || fmt.Sprint(a) != fmt.Sprint(b) || fmt.Sprint(a) == fmt.Sprint(c) {
+		t.Fail()
+	}
+	seen := make(map[int]bool)
+	sorted := true
+	for i, v := range a {
+		seen[v] = true
+		sorted = sorted && v == i
+	}
+	if len(seen) != 100 || sorted {
+		t.Fail()
+	}
+
+	count := 0
+	tree.ForEachShuffled(1, func(e TreeElement) bool {
+		count++
+		return count < 10
+	})
+	New().ForEachShuffled(1, func(e TreeElement) bool {
+		t.Fail()
+		return true
+	})
+	if count != 10 {
+		t.Fail()
+	}
+}
+
+func TestNeighbors(t *testing.T) {
+	tree := New()
+	for i := 0; i < 10; i++ {
+		tree.Insert(Element{i})
+	}
+	leaves := tree.LeafIndices()
+
+	for i, l := range leaves {
+		prev, prevOK, next, nextOK := tree.Neighbors(l)
+		if prevOK != (i > 0) || nextOK != (i < 9) {
+			t.Fail()
+		}
+		if prevOK && prev != leaves[i-1] || !prevOK && prev != -1 {
+			t.Fail()
+		}
+		if nextOK && next != leaves[i+1] || !nextOK && next != -1 {
+			t.Fail()
+		}
+	}
+	if _, prevOK, _, nextOK := tree.Neighbors(tree.root); prevOK || nextOK {
+		t.Fail()
+	}
+
+	tree = New()
+	tree.Insert(Element{1})
+	l, _ := tree.GetSmallestLeaf()
+	if _, prevOK, _, nextOK := tree.Neighbors(l); prevOK || nextOK {
+		t.Fail()
+	}
+}
+
+func TestRangeChannel(t *testing.T) {
+	tree := New()
+	for i := 0; i < 1000; i++ {
+		tree.Insert(Element{i})
+	}
+
+	want := 100
+	for e := range tree.RangeChannel(100, 199, 10) {
+		if !e.Equal(Element{want}) {
+			t.Fail()
+		}
+		want++
+	}
+	if want != 200 {
+		t.Fail()
+	}
+	for range New().RangeChannel(0, 1, 0) {
+		t.Fail()
+	}
+
+	// Canceling stops the producer, which then closes the channel.
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := tree.RangeChannelContext(ctx, 0, 1000, 0)
+	if e := <-ch; !e.Equal(Element{0}) {
+		t.Fail()
+	}
+	cancel()
+	count := 0
+	for range ch {
+		count++
+	}
+	if count > 1 {
+		t.Fail()
+	}
+}
+
+func TestClosestToMean(t *testing.T) {
+	if _, err := New().ClosestToMean(); err == nil {
+		t.Fail()
+	}
+
+	for _, tree := range []*Tree23{New(), NewDescending()} {
+		// The mean is 10.5.
+		for _, v := range []float64{1, 2, 3, 10, 12, 35} {
+			tree.Insert(FloatElement{v})
+		}
+		if l, err := tree.ClosestToMean(); err != nil || tree.GetValue(l).ExtractValue() != 10 {
+			t.Fail()
+		}
+		tree.Insert(FloatElement{math.Inf(1)})
+		if l, err := tree.ClosestToMean(); err != nil || !math.IsInf(tree.GetValue(l).ExtractValue(), 1) {
+			t.Fail()
+		}
+		tree.Insert(FloatElement{math.Inf(-1)})
+		if _, err := tree.ClosestToMean(); err == nil {
+			t.Fail()
+		}
+	}
+}
+
+func TestForEachStride(t *testing.T) {
+	tree := New()
+	for i := 0; i < 100; i++ {
+		tree.Insert(Element{i})
+	}
+
+	for _, k := range []int{1, 3, 7, 99, 100, 1000} {
+		want := 0
+		tree.ForEachStride(k, func(e TreeElement) bool {
+			if !e.Equal(Element{want}) {
+				t.Fail()
+			}
+			want += k
+			return true
+		})
+		if want != (99/k+1)*k {
+			t.Fail()
+		}
+	}
+
+	count := 0
+	tree.ForEachStride(2, func(e TreeElement) bool {
+		count++
+		return count < 5
+	})
+	called := false
+	tree.ForEachStride(0, func(TreeElement) bool { called = true; return true })
+	tree.ForEachStride(-1, func(TreeElement) bool { called = true; return true })
+	if count != 5 || called {
+		t.Fail()
+	}
+	New().ForEachStride(1, func(e TreeElement) bool {
+		t.Fail()
+		return true
+	})
+}
+
+func TestCopyFrom(t *testing.T) {
+	src := NewDescending()
+	for i := 0; i < 1000; i++ {
+		src.Insert(Element{i % 300})
+	}
+	for i := 0; i < 100; i++ {
+		src.Delete(Element{i})
+	}
+
+	dst := New()
+	inserted := 0
+	dst.SetHooks(func(TreeElement) { inserted++ }, nil)
+	for i := 0; i < 5000; i++ {
+		dst.Insert(Element{-i})
+	}
+	inserted = 0
+	dst.CopyFrom(src)
+	if dst.Len() != src.Len() || inserted != src.Len() || !dst.Invariant() {
+		t.Fail()
+	}
+	a, b := src.ToSlice(), dst.ToSlice()
+	for i := range a {
+		if !a[i].Equal(b[i]) {
+			t.Fail()
+		}
+	}
+
+	// Both trees are independent afterwards.
+	dst.Insert(Element{1000})
+	src.Delete(Element{299})
+	if dst.CountEqual(Element{299}) != 3 || src.CountEqual(Element{1000}) != 0 || !src.Invariant() || !dst.Invariant() {
+		t.Fail()
+	}
+	if l, _ := dst.GetSmallestLeaf(); !dst.GetValue(l).Equal(Element{1000}) {
+		t.Fail()
+	}
+
+	// Copying again reuses the memory.
+	nodes := &dst.treeNodes[0]
+	dst.CopyFrom(src)
+	if &dst.treeNodes[0] != nodes || dst.Len() != src.Len() || !dst.Invariant() {
+		t.Fail()
+	}
+	dst.CopyFrom(New())
+	if dst.Len() != 0 || !dst.Invariant() {
+		t.Fail()
+	}
+
+	// A set takes over the order of src, so it never holds equal elements afterwards.
+	set := NewSet()
+	set.Insert(Element{1})
+	src = New()
+	src.Insert(Element{5})
+	src.Insert(Element{5})
+	set.CopyFrom(src)
+	if set.unique || set.Len() != 2 {
+		t.Fail()
+	}
+	src = NewSet()
+	src.Insert(Element{5})
+	dst.CopyFrom(src)
+	dst.Insert(Element{5})
+	if !dst.unique || dst.Len() != 1 {
+		t.Fail()
+	}
+}
+
+func TestCheckFreeListDisjoint(t *testing.T) {
+	tree := New()
+	for i := 0; i < 1000; i++ {
+		tree.Insert(Element{i})
+	}
+	for i := 0; i < 1000; i += 3 {
+		tree.Delete(Element{i})
+	}
+	if ok, n := tree.CheckFreeListDisjoint(); !ok || n != -1 || tree.treeNodesFreePositions.len() == 0 {
+		t.Fail()
+	}
+
+	// A reachable leaf in the free stack is not detected by the memory check alone.
+	l, _ := tree.Find(Element{500})
+	tree.treeNodesFreePositions.push(l)
+	if ok, n := tree.CheckFreeListDisjoint(); ok || n != l || !tree.memoryCheck() || tree.Invariant() {
+		t.Fail()
+	}
+	tree.treeNodesFreePositions.pop()
+	tree.treeNodesFreePositions.push(tree.root)
+	if ok, n := tree.CheckFreeListDisjoint(); ok || n != tree.root {
+		t.Fail()
+	}
+}
+
+func TestInsertBounded(t *testing.T) {
+	tree := New()
+	tree.SetMaxLen(10, RejectWhenFull)
+	for i := 0; i < 20; i++ {
+		if tree.InsertBounded(Element{i}) != (i < 10) {
+			t.Fail()
+		}
+	}
+	if max, _ := tree.MaxValue(); tree.Len() != 10 || max != 9 {
+		t.Fail()
+	}
+
+	tree = New()
+	deleted := 0
+	tree.SetHooks(nil, func(TreeElement) { deleted++ })
+	tree.SetMaxLen(10, EvictSmallest)
+	for i := 0; i < 100; i++ {
+		if !tree.InsertBounded(Element{i}) {
+			t.Fail()
+		}
+	}
+	if min, _ := tree.MinValue(); tree.Len() != 10 || min != 90 || deleted != 90 || !tree.Invariant() {
+		t.Fail()
+	}
+	if tree.InsertBounded(Element{5}) || tree.Len() != 10 || deleted != 91 {
+		t.Fail()
+	}
+
+	tree = New()
+	tree.SetMaxLen(10, EvictLargest)
+	for i := 100; i > 0; i-- {
+		tree.InsertBounded(Element{i})
+	}
+	if max, _ := tree.MaxValue(); tree.Len() != 10 || max != 10 || !tree.Invariant() {
+		t.Fail()
+	}
+	if tree.InsertBounded(Element{50}) || !tree.InsertBounded(Element{0}) {
+		t.Fail()
+	}
+
+	// Lowering the limit shrinks the tree with the next insert.
+	tree.SetMaxLen(3, EvictLargest)
+	if !tree.InsertBounded(Element{1}) || tree.Len() != 3 || !tree.Invariant() {
+		t.Fail()
+	}
+	if l, _ := tree.GetLargestLeaf(); !tree.GetValue(l).Equal(Element{1}) {
+		t.Fail()
+	}
+	tree.SetMaxLen(0, RejectWhenFull)
+	tree.InsertBounded(Element{7})
+	if tree.Len() != 4 {
+		t.Fail()
+	}
+}
+
+func TestInsertBoundedUndo(t *testing.T) {
+	tree := New()
+	tree.SetMaxLen(3, EvictSmallest)
+	for i := 0; i < 3; i++ {
+		tree.InsertBounded(Element{i})
+	}
+	if !tree.InsertBounded(Element{10}) || !tree.Undo() {
+		t.Fail()
+	}
+	if !tree.EqualsSlice([]TreeElement{Element{0}, Element{1}, Element{2}}) || !tree.Invariant() {
+		t.Fail()
+	}
+
+	// The new element is evicted right away, so there is nothing to undo.
+	if tree.InsertBounded(Element{-1}) || tree.Undo() || tree.Len() != 3 {
+		t.Fail()
+	}
+
+	// More than one eviction can not be undone.
+	tree.SetMaxLen(1, EvictSmallest)
+	if !tree.InsertBounded(Element{5}) || tree.Undo() || tree.Len() != 1 {
+		t.Fail()
+	}
+}
+
+func TestPercentileRank(t *testing.T) {
+	if !math.IsNaN(New().PercentileRank(1)) {
+		t.Fail()
+	}
+	for _, tree := range []*Tree23{New(), NewDescending()} {
+		for i := 0; i < 100; i++ {
+			tree.Insert(Element{i})
+		}
+		tree.Insert(Element{50})
+		tree.Insert(Element{50})
+		tree.Insert(Element{50})
+
+		for _, c := range []struct{ v, want float64 }{{-5, 0}, {0, 0}, {0.5, 1.0 / 103}, {50, 50.0 / 103}, {51, 54.0 / 103}, {99, 102.0 / 103}, {100, 1}, {math.Inf(1), 1}} {
+			if tree.PercentileRank(c.v) != c.want {
+				t.Fail()
+			}
+		}
+	}
+}
+
+func TestMapMonotonic(t *testing.T) {
+	for _, tree := range []*Tree23{New(), NewDescending()} {
+		tree.MapMonotonic(func(e TreeElement) TreeElement { return e })
+		for i := 0; i < 1000; i++ {
+			tree.Insert(Element{i % 700})
+		}
+		tree.MapMonotonic(func(e TreeElement) TreeElement {
+			return Element{e.(Element).E*2 + 5000}
+		})
+
+		if ok, _ := tree.CheckOrdering(); !ok || !tree.Invariant() || tree.Len() != 1000 {
+			t.Fail()
+		}
+		if ok, _ := tree.CheckMaxChildren(); !ok {
+			t.Fail()
+		}
+		for i := 0; i < 700; i += 7 {
+			want := 1
+			if i < 300 {
+				want = 2
+			}
+			if l, err := tree.Find(Element{i*2 + 5000}); err != nil || !tree.GetValue(l).Equal(Element{i*2 + 5000}) || tree.CountEqual(Element{i*2 + 5000}) != want {
+				t.Fail()
+			}
+		}
+		if _, err := tree.Find(Element{10}); err == nil {
+			t.Fail()
+		}
+		tree.Insert(Element{5001})
+		if tree.CountEqual(Element{5001}) != 1 || !tree.Invariant() {
+			t.Fail()
+		}
+	}
+}
+
+func TestNewCapacityChecked(t *testing.T) {
+	for _, n := range []int{-10, 0} {
+		if _, err := NewCapacityChecked(n); err == nil {
+			t.Fail()
+		}
+		tree := NewCapacity(n)
+		tree.Insert(Element{1})
+		tree.Insert(Element{2})
+		if tree.Len() != 2 || !tree.Invariant() {
+			t.Fail()
+		}
+	}
+	if tree, err := NewCapacityChecked(100); err != nil || len(tree.treeNodes) != 100 || !tree.Invariant() {
+		t.Fail()
+	}
+}
+
+func TestStructuralOps(t *testing.T) {
+	tree := New()
+	if splits, merges := tree.StructuralOps(); splits != 0 || merges != 0 {
+		t.Fail()
+	}
+	var elems []TreeElement
+	for i := 0; i < 1000; i++ {
+		tree.Insert(Element{i})
+		elems = append(elems, Element{i})
+	}
+	splits, merges := tree.StructuralOps()
+	if merges != 0 {
+		t.Fail()
+	}
+	// Every split creates at least one more inner node.
+	twoNodes, threeNodes, _ := tree.NodeArityHistogram()
+	if splits < 500 || int(splits) >= twoNodes+threeNodes {
+		t.Fail()
+	}
+
+	for i := 0; i < 1000; i++ {
+		tree.Delete(Element{i})
+	}
+	if s, merges := tree.StructuralOps(); s != splits || merges < 500 || tree.Len() != 0 {
+		t.Fail()
+	}
+
+	bulk, _ := BuildFromSorted(elems)
+	if splits, merges := bulk.StructuralOps(); splits != 0 || merges != 0 {
+		t.Fail()
+	}
+}
+
+func TestSelectRange(t *testing.T) {
+	tree := New()
+	for i := 0; i < 100; i++ {
+		tree.Insert(Element{i})
+	}
+
+	for _, c := range [][3]int{{10, 20, 10}, {0, 100, 0}, {-5, 3, 0}, {90, 200, 90}, {80, 80, 0}, {50, 40, 0}, {100, 101, 0}, {99, 100, 99}} {
+		s := tree.SelectRange(c[0], c[1])
+		want := min(max(c[1], 0), 100) - min(max(c[0], 0), 100)
+		if s == nil || len(s) != max(want, 0) {
+			t.Fail()
+		}
+		for i, e := range s {
+			if !e.Equal(Element{c[2] + i}) {
+				t.Fail()
+			}
+		}
+	}
+	if s := New().SelectRange(0, 10); s == nil || len(s) != 0 {
+		t.Fail()
+	}
+}
+
+func TestInterpolatedQuantile(t *testing.T) {
+	if _, err := New().InterpolatedQuantile(0.5); err == nil {
+		t.Fail()
+	}
+
+	for _, tree := range []*Tree23{New(), NewDescending()} {
+		for _, v := range []float64{1, 2, 4, 8, 16} {
+			tree.Insert(FloatElement{v})
+		}
+		for _, c := range [][2]float64{{0, 1}, {0.25, 2}, {0.5, 4}, {0.625, 6}, {0.9, 12.8}, {1, 16}} {
+			if v, err := tree.InterpolatedQuantile(c[0]); err != nil || math.Abs(v-c[1]) > 1e-9 {
+				t.Fail()
+			}
+		}
+		for _, q := range []float64{-0.1, 1.1, math.NaN()} {
+			if _, err := tree.InterpolatedQuantile(q); err == nil {
+				t.Fail()
+			}
+		}
+		tree.Insert(FloatElement{math.Inf(1)})
+		tree.Insert(FloatElement{math.Inf(1)})
+		if v, _ := tree.InterpolatedQuantile(0.95); !math.IsInf(v, 1) {
+			t.Fail()
+		}
+		if v, _ := tree.InterpolatedQuantile(0.7); !math.IsInf(v, 1) {
+			t.Fail()
+		}
+	}
+
+	tree := New()
+	tree.Insert(FloatElement{3})
+	if v, err := tree.InterpolatedQuantile(0.3); err != nil || v != 3 {
+		t.Fail()
+	}
+}
+
+func TestEqualsSlice(t *testing.T) {
+	tree := New()
+	if !tree.EqualsSlice(nil) || tree.DiffSlice([]TreeElement{Element{1}}) != 0 {
+		t.Fail()
+	}
+
+	var expected []TreeElement
+	for i := 0; i < 10; i++ {
+		tree.Insert(Element{9 - i})
+		expected = append(expected, Element{i})
+	}
+	if !tree.EqualsSlice(expected) || tree.DiffSlice(expected) != -1 {
+		t.Fail()
+	}
+	if tree.EqualsSlice(expected[:9]) || tree.DiffSlice(expected[:9]) != 9 {
+		t.Fail()
+	}
+	if tree.EqualsSlice(append(expected, Element{10})) || tree.DiffSlice(append(expected, Element{10})) != 10 {
+		t.Fail()
+	}
+	expected[4] = Element{40}
+	if tree.EqualsSlice(expected) || tree.DiffSlice(expected) != 4 {
+		t.Fail()
+	}
+}
+
+func TestMarshalBinary(t *testing.T) {
+	tree := New()
+	for i := 0; i < 100; i++ {
+		if i%2 == 0 {
+			tree.Insert(Element{i})
+		} else {
+			tree.Insert(FloatElement{float64(i) + 0.5})
+		}
+	}
+	data, err := tree.MarshalBinary()
+	if err != nil {
+		t.Fail()
+	}
+
+	loaded := New()
+	loaded.Insert(Element{1000})
+	if err := loaded.UnmarshalBinary(data); err == nil || loaded.Len() != 1 {
+		t.Fail()
+	}
+	loaded.RegisterElementType("tree23.Element", func(b []byte) (TreeElement, error) {
+		return makeElement(b), nil
+	})
+	loaded.RegisterElementType("tree23.FloatElement", func(b []byte) (TreeElement, error) {
+		if len(b) != 8 {
+			return nil, fmt.Errorf("invalid FloatElement")
+		}
+		return FloatElement{math.Float64frombits(binary.LittleEndian.Uint64(b))}, nil
+	})
+	if err := loaded.UnmarshalBinary(data); err != nil || !loaded.EqualsSlice(tree.ToSlice()) || !loaded.Invariant() {
+		t.Fail()
+	}
+
+	for _, d := range [][]byte{nil, data[:len(data)-1], append(data, 1)} {
+		if err := loaded.UnmarshalBinary(d); err == nil || loaded.Len() != 100 {
+			t.Fail()
+		}
+	}
+
+	tree = New()
+	tree.Insert(ValueElement{1, 1})
+	if _, err := tree.MarshalBinary(); err == nil {
+		t.Fail()
+	}
+}
+
+func TestIsEmptyTree(t *testing.T) {
+	tree := New()
+	if !tree.IsEmptyTree() {
+		t.Fail()
+	}
+	for i := 0; i < 10; i++ {
+		tree.Insert(Element{i})
+		if tree.IsEmptyTree() || tree.IsEmptyTree() != tree.IsEmpty(tree.root) {
+			t.Fail()
+		}
+	}
+	for i := 0; i < 10; i++ {
+		tree.Delete(Element{i})
+	}
+	if !tree.IsEmptyTree() || !tree.IsEmpty(tree.root) {
+		t.Fail()
+	}
+	tree.Insert(Element{1})
+	tree.Clear()
+	if !tree.IsEmptyTree() {
+		t.Fail()
+	}
+}
+
+func TestNearest(t *testing.T) {
+	if _, err := New().Nearest(1, 0); err == nil {
+		t.Fail()
+	}
+
+	for _, tree := range []*Tree23{New(), NewDescending()} {
+		for i := 0; i < 10; i++ {
+			tree.Insert(Element{i * 10})
+		}
+		for _, c := range []struct {
+			v     float64
+			dir   int
+			want  int
+			found bool
+		}{
+			{34, -1, 30, true}, {34, 1, 40, true}, {34, 0, 30, true}, {36, 0, 40, true}, {35, 0, 30, true},
+			{40, -1, 40, true}, {40, 1, 40, true}, {-5, -1, 0, false}, {-5, 1, 0, true}, {-5, 0, 0, true},
+			{95, 1, 0, false}, {95, -1, 90, true}, {95, 0, 90, true},
+		} {
+			l, err := tree.Nearest(c.v, c.dir)
+			if (err == nil) != c.found || c.found && tree.GetValue(l).(Element).E != c.want {
+				t.Fail()
+			}
+		}
+	}
+}
+
+func TestSetAutoRepair(t *testing.T) {
+	tree := New()
+	var logs []string
+	tree.SetAutoRepair(true)
+	tree.SetRepairLogger(func(msg string) { logs = append(logs, msg) })
+	for i := 0; i < 100; i++ {
+		tree.Insert(Element{i})
+	}
+	for i := 0; i < 50; i++ {
+		tree.Delete(Element{i * 2})
+	}
+	if len(logs) != 0 {
+		t.Fail()
+	}
+
+	// Break a link far away from the next deleted element.
+	l, _ := tree.Find(Element{81})
+	n, _ := tree.Find(Element{91})
+	tree.treeNodes[l].next = n
+	tree.Delete(Element{11})
+	if len(logs) != 1 || !strings.Contains(logs[0], "Delete") || !tree.CheckLeafList() || !tree.Invariant() {
+		t.Fail()
+	}
+
+	tree.treeNodes[l].next = n
+	tree.SetAutoRepair(false)
+	tree.Delete(Element{13})
+	if len(logs) != 1 || tree.CheckLeafList() {
+		t.Fail()
+	}
+}
+
+func TestFprintWith(t *testing.T) {
+	tree := New()
+	for i := 1; i <= 3; i++ {
+		tree.Insert(ValueElement{i, i * 10})
+	}
+
+	var buf bytes.Buffer
+	tree.FprintWith(&buf, func(e TreeElement) string {
+		return fmt.Sprintf("id%v", e.(ValueElement).ID)
+	})
+	expected := "--1\n" +
+		"  |--(prev: id30. value: id10. next: id20)\n" +
+		"--2\n" +
+		"  |--(prev: id10. value: id20. next: id30)\n" +
+		"--3\n" +
+		"  |--(prev: id20. value: id30. next: id10)\n\n"
+	if buf.String() != expected {
+		t.Logf("%q", buf.String())
+		t.Fail()
+	}
+
+	buf.Reset()
+	New().FprintWith(&buf, func(e TreeElement) string { return "" })
+	if buf.String() != "\n" {
+		t.Fail()
+	}
+}
+
+func TestLevelSizes(t *testing.T) {
+	tree := New()
+	if sizes := tree.LevelSizes(); sizes == nil || len(sizes) != 0 {
+		t.Fail()
+	}
+
+	tree.Insert(Element{1})
+	if sizes := tree.LevelSizes(); len(sizes) != 1 || sizes[0] != 1 {
+		t.Fail()
+	}
+
+	for i := 2; i <= 1000; i++ {
+		tree.Insert(Element{i})
+	}
+	sizes := tree.LevelSizes()
+	if len(sizes) != tree.height(tree.root)+1 || sizes[0] != 1 || sizes[len(sizes)-1] != 1000 {
+		t.Fail()
+	}
+	for i := 1; i < len(sizes); i++ {
+		if sizes[i] < 2*sizes[i-1] || sizes[i] > 3*sizes[i-1] {
+			t.Fail()
+		}
+	}
+}
+
+func TestFindRange(t *testing.T) {
+	tree := New()
+	it := tree.FindRange(0, 10)
+	if it.Value() != nil || it.Next() || it.Value() != nil {
+		t.Fail()
+	}
+
+	for i := 0; i < 100; i++ {
+		tree.Insert(Element{i})
+	}
+
+	var got []int
+	for it := tree.FindRange(10.5, 20); it.Next(); {
+		got = append(got, it.Value().(Element).E)
+	}
+	if len(got) != 10 || got[0] != 11 || got[9] != 20 {
+		t.Fail()
+	}
+
+	// The iteration stops at the largest element instead of wrapping around.
+	got = got[:0]
+	for it := tree.FindRange(95, 1000); it.Next(); {
+		got = append(got, it.Value().(Element).E)
+	}
+	if len(got) != 5 || got[4] != 99 {
+		t.Fail()
+	}
+
+	it = tree.FindRange(200, 300)
+	if it.Next() || tree.FindRange(20, 10).Next() || tree.FindRange(30.2, 30.8).Next() {
+		t.Fail()
+	}
+
+	// Abandoning an iterator early needs no cleanup.
+	it = tree.FindRange(0, 99)
+	if !it.Next() || it.Value().(Element).E != 0 || !tree.Invariant() {
+		t.Fail()
+	}
+
+	desc := NewDescending()
+	for i := 0; i < 100; i++ {
+		desc.Insert(Element{i})
+	}
+	got = got[:0]
+	for it := desc.FindRange(10, 13); it.Next(); {
+		got = append(got, it.Value().(Element).E)
+	}
+	if len(got) != 4 || got[0] != 13 || got[3] != 10 {
+		t.Fail()
+	}
+}
+
+func TestTransformRange(t *testing.T) {
+	tree := New()
+	if tree.TransformRange(0, 10, func(e TreeElement) TreeElement { return e }) != 0 {
+		t.Fail()
+	}
+
+	for i := 0; i < 100; i++ {
+		tree.Insert(Element{i})
+	}
+
+	// Every shifted element is equal to the next unshifted one, so deleting by element would remove the wrong ones.
+	n := tree.TransformRange(10, 19, func(e TreeElement) TreeElement {
+		return Element{e.(Element).E + 1}
+	})
+	if n != 10 || tree.Len() != 100 || !tree.Invariant() {
+		t.Fail()
+	}
+	if tree.CountEqual(Element{20}) != 2 || tree.CountEqual(Element{15}) != 1 || tree.CountEqual(Element{10}) != 0 {
+		t.Fail()
+	}
+
+	// Moving elements out of the range.
+	values := New()
+	for i := 0; i < 100; i++ {
+		values.Insert(ValueElement{i, i})
+	}
+	n = values.TransformRange(50, 59, func(e TreeElement) TreeElement {
+		v := e.(ValueElement)
+		return ValueElement{v.V + 1000, v.ID}
+	})
+	if n != 10 || values.Len() != 100 || !values.Invariant() {
+		t.Fail()
+	}
+	largest, _ := values.GetLargestLeaf()
+	if v := values.GetValue(largest).(ValueElement); v.V != 1059 || v.ID != 59 {
+		t.Fail()
+	}
+	if _, err := values.Find(ValueElement{1055, 55}); err != nil {
+		t.Fail()
+	}
+	if l, err := values.FindFirstLargerLeaf(50); err != nil || values.GetValue(l).(ValueElement).V != 60 {
+		t.Fail()
+	}
+}
+
+func TestIsBalanced(t *testing.T) {
+	tree := New()
+	if !tree.IsBalanced() {
+		t.Fail()
+	}
+	for i := 0; i < 1000; i++ {
+		tree.Insert(Element{i})
+		if !tree.IsBalanced() {
+			t.Fail()
+		}
+	}
+	for i := 0; i < 1000; i += 3 {
+		tree.Delete(Element{i})
+		if !tree.IsBalanced() {
+			t.Fail()
+		}
+	}
+
+	// Hang the right-most leaf directly below the root.
+	root := tree.root
+	c := tree.treeNodes[root].cCount - 1
+	largest, _ := tree.GetLargestLeaf()
+	tree.treeNodes[root].children[c].child = largest
+	if tree.IsBalanced() {
+		t.Fail()
+	}
+}
+
+func TestBuildParallel(t *testing.T) {
+	if tree := BuildParallel(nil, 4); tree.Len() != 0 || !tree.Invariant() {
+		t.Fail()
+	}
+
+	r := rand.New(rand.NewSource(1))
+	elems := make([]TreeElement, 1000)
+	for i := range elems {
+		elems[i] = ValueElement{r.Intn(200), i}
+	}
+	input := append([]TreeElement(nil), elems...)
+
+	expected := New()
+	expected.Replace(elems)
+	for _, workers := range []int{-1, 0, 1, 2, 3, 7, 16, 5000} {
+		tree := BuildParallel(elems, workers)
+		if tree.Len() != len(elems) || !tree.Invariant() || !tree.EqualsSlice(expected.ToSlice()) {
+			t.Fail()
+		}
+	}
+	for i := range elems {
+		if elems[i] != input[i] {
+			t.Fail()
+		}
+	}
+}
+
+func benchmarkBuildElements() []TreeElement {
+	r := rand.New(rand.NewSource(1))
+	elems := make([]TreeElement, 1000000)
+	for i := range elems {
+		elems[i] = Element{r.Int()}
+	}
+	return elems
+}
+
+func BenchmarkBuildParallel(b *testing.B) {
+	elems := benchmarkBuildElements()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		BuildParallel(elems, 8)
+	}
+}
+
+func BenchmarkBuildFromSortedCopy(b *testing.B) {
+	elems := benchmarkBuildElements()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		sorted := append([]TreeElement(nil), elems...)
+		sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].ExtractValue() < sorted[j].ExtractValue() })
+		BuildFromSorted(sorted)
+	}
+}
+
+func TestDedup(t *testing.T) {
+	keepFirst := func(a, b TreeElement) TreeElement { return a }
+	tree := New()
+	if n, err := tree.Dedup(keepFirst); n != 0 || err != nil {
+		t.Fail()
+	}
+
+	for i := 0; i < 100; i++ {
+		for j := 0; j <= i%4; j++ {
+			tree.Insert(Element{i})
+		}
+	}
+	// 25 elements each with 1, 2, 3 and 4 copies.
+	if n, err := tree.Dedup(keepFirst); n != 25*(0+1+2+3) || err != nil {
+		t.Fail()
+	}
+	if tree.Len() != 100 || tree.CountDistinct() != 100 || !tree.Invariant() {
+		t.Fail()
+	}
+	if n, err := tree.Dedup(keepFirst); n != 0 || err != nil {
+		t.Fail()
+	}
+
+	// keep picks the element with the largest count among equal ones.
+	counts := New()
+	counts.Insert(countedElement{1, 5})
+	counts.Insert(countedElement{2, 1})
+	counts.Insert(countedElement{2, 7})
+	counts.Insert(countedElement{2, 3})
+	counts.Insert(countedElement{3, 2})
+	counts.Insert(countedElement{3, 4})
+	n, err := counts.Dedup(func(a, b TreeElement) TreeElement {
+		if b.(countedElement).Count > a.(countedElement).Count {
+			return b
+		}
+		return a
+	})
+	s := counts.ToSlice()
+	if n != 3 || err != nil || len(s) != 3 || s[0].(countedElement).Count != 5 || s[1].(countedElement).Count != 7 ||
+		s[2].(countedElement).Count != 4 || !counts.Invariant() {
+		t.Fail()
+	}
+
+	// A combined element that is not equal to the run is rejected before anything is removed.
+	counts.Insert(countedElement{2, 1})
+	n, err = counts.Dedup(func(a, b TreeElement) TreeElement { return countedElement{9, 0} })
+	if n != 0 || err == nil || counts.Len() != 4 || counts.CountEqual(countedElement{2, 0}) != 2 || !counts.Invariant() {
+		t.Fail()
+	}
+}
+
+// countedElement is equal to all other elements with the same value, independent of the count.
+type countedElement struct {
+	V     int
+	Count int
+}
+
+func (e countedElement) Equal(e2 TreeElement) bool {
+	return e.V == e2.(countedElement).V
+}
+func (e countedElement) ExtractValue() float64 {
+	return float64(e.V)
+}